@@ -0,0 +1,157 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright Copyright (c) 2022 NetLOX Inc
+
+package loxilib
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// AddrBlockInfo - Properties of a special-purpose address block
+// Flags follow the IANA special-purpose address registries i.e. whether an
+// address from the block is valid as source or destination, can be
+// forwarded by routers and is globally reachable
+type AddrBlockInfo struct {
+	Cidr        string
+	Name        string
+	RFC         string
+	Source      bool
+	Destination bool
+	Forwardable bool
+	Global      bool
+}
+
+// AddrRegistry - context container for address block classification
+type AddrRegistry struct {
+	v4     *TrieRoot
+	v6     *TrieRoot
+	mapped *TrieRoot
+}
+
+// IANA IPv4/IPv6 special-purpose address registries (RFC 6890 and
+// successors) along with multicast ranges
+var addrSpecialBlocks = []AddrBlockInfo{
+	{"0.0.0.0/8", "This network", "RFC791", true, false, false, false},
+	{"0.0.0.0/32", "This host on this network", "RFC1122", true, false, false, false},
+	{"10.0.0.0/8", "Private-Use", "RFC1918", true, true, true, false},
+	{"100.64.0.0/10", "Shared Address Space", "RFC6598", true, true, true, false},
+	{"127.0.0.0/8", "Loopback", "RFC1122", false, false, false, false},
+	{"169.254.0.0/16", "Link Local", "RFC3927", true, true, false, false},
+	{"172.16.0.0/12", "Private-Use", "RFC1918", true, true, true, false},
+	{"192.0.0.0/24", "IETF Protocol Assignments", "RFC6890", false, false, false, false},
+	{"192.0.0.0/29", "IPv4 Service Continuity Prefix", "RFC7335", true, true, true, false},
+	{"192.0.0.8/32", "IPv4 dummy address", "RFC7600", true, false, false, false},
+	{"192.0.0.9/32", "Port Control Protocol Anycast", "RFC7723", true, true, true, true},
+	{"192.0.0.10/32", "Traversal Using Relays around NAT Anycast", "RFC8155", true, true, true, true},
+	{"192.0.0.170/32", "NAT64/DNS64 Discovery", "RFC8880", false, false, false, false},
+	{"192.0.0.171/32", "NAT64/DNS64 Discovery", "RFC8880", false, false, false, false},
+	{"192.0.2.0/24", "Documentation (TEST-NET-1)", "RFC5737", false, false, false, false},
+	{"192.31.196.0/24", "AS112-v4", "RFC7535", true, true, true, true},
+	{"192.52.193.0/24", "AMT", "RFC7450", true, true, true, true},
+	{"192.88.99.0/24", "Deprecated (6to4 Relay Anycast)", "RFC7526", false, false, false, false},
+	{"192.168.0.0/16", "Private-Use", "RFC1918", true, true, true, false},
+	{"192.175.48.0/24", "Direct Delegation AS112 Service", "RFC7534", true, true, true, true},
+	{"198.18.0.0/15", "Benchmarking", "RFC2544", true, true, true, false},
+	{"198.51.100.0/24", "Documentation (TEST-NET-2)", "RFC5737", false, false, false, false},
+	{"203.0.113.0/24", "Documentation (TEST-NET-3)", "RFC5737", false, false, false, false},
+	{"224.0.0.0/4", "Multicast", "RFC5771", false, true, true, true},
+	{"224.0.0.0/24", "Local Network Control Block", "RFC5771", false, true, false, false},
+	{"240.0.0.0/4", "Reserved", "RFC1112", false, false, false, false},
+	{"255.255.255.255/32", "Limited Broadcast", "RFC919", false, true, false, false},
+
+	{"::1/128", "Loopback Address", "RFC4291", false, false, false, false},
+	{"::/128", "Unspecified Address", "RFC4291", true, false, false, false},
+	{"::ffff:0:0/96", "IPv4-mapped Address", "RFC4291", false, false, false, false},
+	{"64:ff9b::/96", "IPv4-IPv6 Translat.", "RFC6052", true, true, true, true},
+	{"64:ff9b:1::/48", "IPv4-IPv6 Translat.", "RFC8215", true, true, true, false},
+	{"100::/64", "Discard-Only Address Block", "RFC6666", true, true, true, false},
+	{"2001::/23", "IETF Protocol Assignments", "RFC2928", false, false, false, false},
+	{"2001::/32", "TEREDO", "RFC4380", true, true, true, false},
+	{"2001:1::1/128", "Port Control Protocol Anycast", "RFC7723", true, true, true, true},
+	{"2001:1::2/128", "Traversal Using Relays around NAT Anycast", "RFC8155", true, true, true, true},
+	{"2001:2::/48", "Benchmarking", "RFC5180", true, true, true, false},
+	{"2001:3::/32", "AMT", "RFC7450", true, true, true, true},
+	{"2001:4:112::/48", "AS112-v6", "RFC7535", true, true, true, true},
+	{"2001:20::/28", "ORCHIDv2", "RFC7343", true, true, true, true},
+	{"2001:30::/28", "Drone Remote ID Protocol Entity Tags (DETs) Prefix", "RFC9374", true, true, true, true},
+	{"2001:db8::/32", "Documentation", "RFC3849", false, false, false, false},
+	{"2002::/16", "6to4", "RFC3056", true, true, true, false},
+	{"2620:4f:8000::/48", "Direct Delegation AS112 Service", "RFC7534", true, true, true, true},
+	{"3fff::/20", "Documentation", "RFC9637", false, false, false, false},
+	{"5f00::/16", "Segment Routing (SRv6) SIDs", "RFC9602", true, true, true, false},
+	{"fc00::/7", "Unique-Local", "RFC4193", true, true, true, false},
+	{"fe80::/10", "Link-Local Unicast", "RFC4291", true, true, false, false},
+	{"ff00::/8", "Multicast", "RFC4291", false, true, true, true},
+}
+
+// NewAddrRegistry - Create an address registry prefilled with the IANA
+// special-purpose address blocks
+func NewAddrRegistry() *AddrRegistry {
+	R := new(AddrRegistry)
+	R.v4 = TrieInit(false)
+	R.v6 = TrieInit(true)
+	R.mapped = TrieInit(false)
+	for _, info := range addrSpecialBlocks {
+		R.AddAddrBlock(info)
+	}
+	return R
+}
+
+// trie returns the trie holding s, which is an address or a cidr, along
+// with s in the form used in that trie. IP tries store IPv4-mapped IPv6
+// prefixes in IPv4 form, so these are kept in a trie of their own as
+// prefixes of the low 32 bits
+func (R *AddrRegistry) trie(s string) (*TrieRoot, string) {
+	cidr := s
+	if strings.IndexByte(s, '/') < 0 {
+		cidr = s + "/0"
+	}
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil || len(ipNet.Mask) == net.IPv4len {
+		return R.v4, s
+	}
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return R.v6, s
+	}
+	if cidr != s {
+		return R.mapped, ip4.String()
+	}
+	pfxLen, _ := ipNet.Mask.Size()
+	if pfxLen < 8*(net.IPv6len-net.IPv4len) {
+		return R.v6, s
+	}
+	return R.mapped, fmt.Sprintf("%s/%d", ip4, pfxLen-8*(net.IPv6len-net.IPv4len))
+}
+
+// AddAddrBlock - Add a custom address block to the registry
+// Blocks nested within existing ones take precedence for their addresses
+// returns 0 on success or non-zero error code on error
+func (R *AddrRegistry) AddAddrBlock(info AddrBlockInfo) int {
+	blk := new(AddrBlockInfo)
+	*blk = info
+	t, cidr := R.trie(info.Cidr)
+	return t.AddTrie(cidr, blk)
+}
+
+// DelAddrBlock - Delete an address block from the registry
+// returns 0 on success or non-zero error code on error
+func (R *AddrRegistry) DelAddrBlock(cidr string) int {
+	t, cidr := R.trie(cidr)
+	return t.DelTrie(cidr)
+}
+
+// FindAddrBlock - Classify an IP address
+// IP is the IP address in string format
+// returns the most specific block holding the address or nil if none
+func (R *AddrRegistry) FindAddrBlock(IP string) *AddrBlockInfo {
+	t, IP := R.trie(IP)
+	ret, _, data := t.FindTrie(IP)
+	if ret != 0 {
+		return nil
+	}
+	blk := *data.(*AddrBlockInfo)
+	return &blk
+}
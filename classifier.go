@@ -0,0 +1,203 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright Copyright (c) 2022 NetLOX Inc
+
+package loxilib
+
+import (
+	"errors"
+	"net"
+	"sort"
+)
+
+// ClassRule - A 5-tuple classification rule
+// Proto as 0 matches any protocol and a port range with both min and
+// max as 0 matches any port. Among matching rules the one with highest
+// Priority wins, ties are broken in favour of the lower ID
+type ClassRule struct {
+	ID       int
+	Priority int
+	SrcCidr  string
+	DstCidr  string
+	Proto    int
+	SPortMin int
+	SPortMax int
+	DPortMin int
+	DPortMax int
+}
+
+// ClassPkt - Packet 5-tuple to be classified
+type ClassPkt struct {
+	SrcIP net.IP
+	DstIP net.IP
+	Proto int
+	SPort int
+	DPort int
+}
+
+// classSrcNode - data of a source prefix, holds trie of destination prefixes
+type classSrcNode struct {
+	dst *TrieRoot
+}
+
+// classDstNode - data of a destination prefix, holds rules sorted by priority
+type classDstNode struct {
+	rules []*ClassRule
+}
+
+// Classifier - context container for a hierarchical-trie packet classifier
+// Rules are stored in a trie of source prefixes, each pointing to a trie
+// of destination prefixes holding the rules for the prefix pair
+type Classifier struct {
+	v6    bool
+	src   *TrieRoot
+	rules map[int]*ClassRule
+}
+
+// NewClassifier - Create a classifier for IPv4 or IPv6 rules
+func NewClassifier(v6 bool) *Classifier {
+	C := new(Classifier)
+	C.v6 = v6
+	C.src = TrieInit(v6)
+	C.rules = make(map[int]*ClassRule)
+	return C
+}
+
+func classRuleBetter(r1 *ClassRule, r2 *ClassRule) bool {
+	if r2 == nil || r1.Priority > r2.Priority {
+		return true
+	}
+	return r1.Priority == r2.Priority && r1.ID < r2.ID
+}
+
+func classPortMatch(port int, lo int, hi int) bool {
+	if lo == 0 && hi == 0 {
+		return true
+	}
+	return port >= lo && port <= hi
+}
+
+func (r *ClassRule) match(pkt *ClassPkt) bool {
+	if r.Proto != 0 && r.Proto != pkt.Proto {
+		return false
+	}
+	return classPortMatch(pkt.SPort, r.SPortMin, r.SPortMax) &&
+		classPortMatch(pkt.DPort, r.DPortMin, r.DPortMax)
+}
+
+func (C *Classifier) parseCidr(cidr string, tv *trieVar) int {
+	pfxLen := cidr2TrieVar(cidr, tv)
+	if pfxLen < 0 || cidrIsV6(cidr) != C.v6 {
+		return -1
+	}
+	return pfxLen
+}
+
+// AddClassRule - Add a rule to the classifier
+// Port ranges with min above max are rejected
+// returns nil on success or error
+func (C *Classifier) AddClassRule(rule ClassRule) error {
+	var sTv, dTv trieVar
+
+	if _, ok := C.rules[rule.ID]; ok {
+		return errors.New("Exists")
+	}
+	if rule.SPortMin > rule.SPortMax || rule.DPortMin > rule.DPortMax {
+		return errors.New("Range")
+	}
+
+	sPfxLen := C.parseCidr(rule.SrcCidr, &sTv)
+	dPfxLen := C.parseCidr(rule.DstCidr, &dTv)
+	if sPfxLen < 0 || dPfxLen < 0 {
+		return errors.New("Prefix")
+	}
+
+	var sNode *classSrcNode
+	if data, found := C.src.findExactInt(&sTv, sPfxLen); found == true {
+		sNode = data.(*classSrcNode)
+	} else {
+		sNode = &classSrcNode{dst: TrieInit(C.v6)}
+		C.src.addTrieVar(&sTv, sPfxLen, sNode)
+	}
+
+	var dNode *classDstNode
+	if data, found := sNode.dst.findExactInt(&dTv, dPfxLen); found == true {
+		dNode = data.(*classDstNode)
+	} else {
+		dNode = new(classDstNode)
+		sNode.dst.addTrieVar(&dTv, dPfxLen, dNode)
+	}
+
+	r := new(ClassRule)
+	*r = rule
+	dNode.rules = append(dNode.rules, r)
+	sort.Slice(dNode.rules, func(i, j int) bool {
+		return classRuleBetter(dNode.rules[i], dNode.rules[j])
+	})
+	C.rules[rule.ID] = r
+	return nil
+}
+
+// DelClassRule - Delete a rule from the classifier by its ID
+// returns nil on success or error
+func (C *Classifier) DelClassRule(id int) error {
+	var sTv, dTv trieVar
+
+	r, ok := C.rules[id]
+	if !ok {
+		return errors.New("NoEnt")
+	}
+
+	sPfxLen := C.parseCidr(r.SrcCidr, &sTv)
+	dPfxLen := C.parseCidr(r.DstCidr, &dTv)
+	sData, _ := C.src.findExactInt(&sTv, sPfxLen)
+	sNode := sData.(*classSrcNode)
+	dData, _ := sNode.dst.findExactInt(&dTv, dPfxLen)
+	dNode := dData.(*classDstNode)
+
+	for i := range dNode.rules {
+		if dNode.rules[i] == r {
+			dNode.rules = append(dNode.rules[:i], dNode.rules[i+1:]...)
+			break
+		}
+	}
+	if len(dNode.rules) == 0 {
+		sNode.dst.delTrieVar(&dTv, dPfxLen)
+		if CountAllSetBitsInArr(sNode.dst.prefixArr[:]) == 0 &&
+			CountAllSetBitsInArr(sNode.dst.ptrArr[:]) == 0 {
+			C.src.delTrieVar(&sTv, sPfxLen)
+		}
+	}
+	delete(C.rules, id)
+	return nil
+}
+
+// Classify - Find the highest priority rule matching a packet
+// returns the matching rule, which must not be modified, or nil if no rule matches
+func (C *Classifier) Classify(pkt ClassPkt) *ClassRule {
+	var best *ClassRule
+	var sTv, dTv trieVar
+
+	if (pkt.SrcIP.To4() == nil) != C.v6 || (pkt.DstIP.To4() == nil) != C.v6 {
+		return nil
+	}
+	sTv = prefix2TrieVar(pkt.SrcIP, 0)
+	dTv = prefix2TrieVar(pkt.DstIP, 0)
+	keyBits := C.src.keyBits()
+
+	C.src.findCoveringInt(&sTv, 0, keyBits, func(pfxLen int, sData TrieData) {
+		sNode := sData.(*classSrcNode)
+		sNode.dst.findCoveringInt(&dTv, 0, keyBits, func(pfxLen int, dData TrieData) {
+			for _, r := range dData.(*classDstNode).rules {
+				if classRuleBetter(r, best) == false {
+					break
+				}
+				if r.match(&pkt) == true {
+					best = r
+					break
+				}
+			}
+		})
+	})
+
+	return best
+}
@@ -5,22 +5,52 @@ package loxilib
 
 import (
 	"errors"
+	"math/rand"
+	"time"
+)
+
+// Counter allocation policies
+const (
+	// CounterFIFO hands out the counter which has been free the longest
+	CounterFIFO = iota
+	// CounterLIFO hands out the most recently returned counter
+	CounterLIFO
+	// CounterLowestFirst hands out the lowest free counter
+	CounterLowestFirst
+	// CounterRandom hands out the first free counter from a random
+	// offset, similar to RFC 6056 simple port randomization
+	CounterRandom
 )
 
 // Counter - context container
 type Counter struct {
-	begin    int
-	end      int
-	start    int
-	len      int
-	cap      int
-	counters []int
+	begin     int
+	end       int
+	start     int
+	len       int
+	cap       int
+	counters  []int
+	prev      []int
+	allocated []uint8
+	policy    int
+	low       int
+	rnd       *rand.Rand
+	nAlloc    int
+	hq        *counterHold
+	clock     func() time.Time
+	gen       []uint32
+	genMax    uint32
+	hwm       int
+	fails     int
+	thr       []counterThreshold
 }
 
 // NewCounter - Allocate a set of counters
 func NewCounter(begin int, length int) *Counter {
 	counter := new(Counter)
 	counter.counters = make([]int, length)
+	counter.prev = make([]int, length)
+	counter.allocated = make([]uint8, (length+7)/8)
 	counter.begin = begin
 	counter.start = 0
 	counter.end = length - 1
@@ -28,40 +58,287 @@ func NewCounter(begin int, length int) *Counter {
 	counter.cap = length
 	for i := 0; i < length; i++ {
 		counter.counters[i] = i + 1
+		counter.prev[i] = i - 1
 	}
 	counter.counters[length-1] = -1
 	return counter
 }
 
+// unlink removes rid from the free list and marks it allocated
+func (C *Counter) unlink(rid int) {
+	C.detach(rid)
+	C.cap--
+	C.nAlloc++
+	if C.gen != nil {
+		C.gen[rid]++
+		if C.gen[rid] > C.genMax {
+			C.genMax = C.gen[rid]
+		}
+	}
+	SetBitInArr(C.allocated, rid)
+	C.usageChanged()
+}
+
+// detach removes rid from the free list
+func (C *Counter) detach(rid int) {
+	p, n := C.prev[rid], C.counters[rid]
+	if p == -1 {
+		C.start = n
+	} else {
+		C.counters[p] = n
+	}
+	if n == -1 {
+		C.end = p
+	} else {
+		C.prev[n] = p
+	}
+	C.counters[rid] = -1
+	C.prev[rid] = -1
+}
+
 // GetCounter - Get next available counter
 func (C *Counter) GetCounter() (int, error) {
+	C.release()
 	if C.cap <= 0 || C.start == -1 {
+		C.fails++
 		return -1, errors.New("Overflow")
 	}
 
-	C.cap--
-	var rid = C.start
-	if C.start == C.end {
-		C.start = -1
-	} else {
-		C.start = C.counters[rid]
-		C.counters[rid] = -1
+	var rid int
+	switch C.policy {
+	case CounterLowestFirst:
+		rid = C.nextFree(C.low)
+		C.low = rid + 1
+	case CounterRandom:
+		if rid = C.nextFree(C.rnd.Intn(C.len)); rid == -1 {
+			rid = C.nextFree(0)
+		}
+	default:
+		rid = C.start
 	}
+	C.unlink(rid)
 	return rid + C.begin, nil
 }
 
+// nextFree returns the first free counter at or after rid or -1 if none
+func (C *Counter) nextFree(rid int) int {
+	for ; rid < C.len; rid++ {
+		// Skip over fully allocated bytes of the bitmap
+		for rid%8 == 0 && rid+8 <= C.len && C.allocated[rid/8] == 0xff {
+			rid += 8
+		}
+		if rid < C.len && IsBitSetInArr(C.allocated, rid) == false {
+			return rid
+		}
+	}
+	return -1
+}
+
+// SetPolicy - Set the allocation policy of the counter
+// policy is one of CounterFIFO, CounterLIFO, CounterLowestFirst or
+// CounterRandom. Random policy uses a time seeded source unless one is
+// set with SetRandSource
+// returns nil on success or error
+func (C *Counter) SetPolicy(policy int) error {
+	if policy < CounterFIFO || policy > CounterRandom {
+		return errors.New("Policy")
+	}
+	if policy == CounterRandom && C.rnd == nil {
+		C.rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	C.policy = policy
+	return nil
+}
+
+// SetRandSource - Set the source of randomness for CounterRandom policy
+// A fixed seed gives reproducible allocations, a source backed by
+// crypto/rand makes allocations hard to predict
+func (C *Counter) SetRandSource(src rand.Source) {
+	C.rnd = rand.New(src)
+}
+
 // PutCounter - Return a counter to the available list
+// Only counters handed out earlier can be returned, returning a counter
+// twice or one which was never allocated is an error. With quarantine
+// set, the counter is held back for a while before it can be reused
 func (C *Counter) PutCounter(id int) error {
 	if id < C.begin || id >= C.begin+C.len {
 		return errors.New("Range")
 	}
 	rid := id - C.begin
-	var tmp = C.end
-	C.end = rid
-	C.counters[tmp] = rid
+	if IsBitSetInArr(C.allocated, rid) == false || C.isHeld(rid) == true {
+		return errors.New("NotAllocated")
+	}
+	if C.holdOn() == true {
+		C.hold(rid)
+		return nil
+	}
+	C.link(rid)
+	return nil
+}
+
+// link adds rid to the free list as per policy and marks it free
+func (C *Counter) link(rid int) {
+	UnSetBitInArr(C.allocated, rid)
+	if rid < C.low {
+		C.low = rid
+	}
 	C.cap++
+	if C.policy == CounterLIFO {
+		C.prev[rid] = -1
+		C.counters[rid] = C.start
+		if C.start == -1 {
+			C.end = rid
+		} else {
+			C.prev[C.start] = rid
+		}
+		C.start = rid
+	} else {
+		C.linkTail(rid)
+	}
+	C.usageChanged()
+}
+
+// linkTail adds rid at the tail of the free list
+func (C *Counter) linkTail(rid int) {
+	C.counters[rid] = -1
+	C.prev[rid] = C.end
 	if C.start == -1 {
-		C.start = C.end
+		C.start = rid
+		C.prev[rid] = -1
+	} else {
+		C.counters[C.end] = rid
+	}
+	C.end = rid
+}
+
+// IsAllocated - Check whether a counter is currently allocated
+func (C *Counter) IsAllocated(id int) bool {
+	if id < C.begin || id >= C.begin+C.len {
+		return false
+	}
+	return IsBitSetInArr(C.allocated, id-C.begin) && C.isHeld(id-C.begin) == false
+}
+
+// ReserveCounter - Allocate a specific counter if it is available
+// returns nil on success or error
+func (C *Counter) ReserveCounter(id int) error {
+	if id < C.begin || id >= C.begin+C.len {
+		return errors.New("Range")
+	}
+	C.release()
+	rid := id - C.begin
+	if IsBitSetInArr(C.allocated, rid) == true {
+		return errors.New("Busy")
+	}
+	C.unlink(rid)
+	return nil
+}
+
+// ReserveCounterList - Allocate a list of specific counters
+// Either all the counters get allocated or none of them
+// returns nil on success or error
+func (C *Counter) ReserveCounterList(ids []int) error {
+	var seen = make(map[int]struct{}, len(ids))
+
+	C.release()
+	for _, id := range ids {
+		if id < C.begin || id >= C.begin+C.len {
+			return errors.New("Range")
+		}
+		if _, dup := seen[id]; dup || IsBitSetInArr(C.allocated, id-C.begin) == true {
+			return errors.New("Busy")
+		}
+		seen[id] = struct{}{}
+	}
+
+	for _, id := range ids {
+		C.unlink(id - C.begin)
+	}
+	return nil
+}
+
+// ReserveCounterRange - Allocate n consecutive counters from id onwards
+// Either all the counters get allocated or none of them
+// returns nil on success or error
+func (C *Counter) ReserveCounterRange(id int, n int) error {
+	if n <= 0 || id < C.begin || id+n > C.begin+C.len {
+		return errors.New("Range")
+	}
+	C.release()
+	for i := id; i < id+n; i++ {
+		if IsBitSetInArr(C.allocated, i-C.begin) == true {
+			return errors.New("Busy")
+		}
+	}
+	for i := id; i < id+n; i++ {
+		C.unlink(i - C.begin)
+	}
+	return nil
+}
+
+// GetCounterRange - Get n consecutive available counters
+// Smallest free run which fits n counters is used (best fit) to limit
+// fragmentation of the counter space
+// returns first counter of the range or error
+func (C *Counter) GetCounterRange(n int) (int, error) {
+	if n <= 0 || n > C.len {
+		return -1, errors.New("Range")
+	}
+	C.release()
+	if n > C.cap {
+		C.fails++
+		return -1, errors.New("Overflow")
+	}
+
+	bestStart, bestLen := -1, 0
+	runStart := -1
+	for rid := 0; rid <= C.len; rid++ {
+		if rid < C.len && IsBitSetInArr(C.allocated, rid) == false {
+			if runStart == -1 {
+				runStart = rid
+			}
+			continue
+		}
+		if runStart != -1 {
+			if rLen := rid - runStart; rLen >= n && (bestStart == -1 || rLen < bestLen) {
+				bestStart, bestLen = runStart, rLen
+				if rLen == n {
+					break
+				}
+			}
+			runStart = -1
+		}
+		// Skip over fully allocated bytes of the bitmap
+		for rid%8 == 7 && rid+8 < C.len && C.allocated[(rid+1)/8] == 0xff {
+			rid += 8
+		}
+	}
+
+	if bestStart == -1 {
+		C.fails++
+		return -1, errors.New("Fragmented")
+	}
+	for rid := bestStart; rid < bestStart+n; rid++ {
+		C.unlink(rid)
+	}
+	return bestStart + C.begin, nil
+}
+
+// PutCounterRange - Return n consecutive counters from id onwards
+// All the counters in the range need to be allocated, else none is returned
+// returns nil on success or error
+func (C *Counter) PutCounterRange(id int, n int) error {
+	if n <= 0 || id < C.begin || id+n > C.begin+C.len {
+		return errors.New("Range")
+	}
+	for i := id; i < id+n; i++ {
+		if C.IsAllocated(i) == false {
+			return errors.New("NotAllocated")
+		}
+	}
+	for i := id; i < id+n; i++ {
+		C.PutCounter(i)
 	}
 	return nil
 }
@@ -0,0 +1,60 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright Copyright (c) 2022 NetLOX Inc
+
+package loxilib
+
+import (
+	"errors"
+)
+
+// CounterHandle - Counter along with its generation
+// Generation of a counter changes every time it is allocated, so a handle
+// kept after its counter has been returned and reused no longer matches
+type CounterHandle struct {
+	ID  int
+	Gen uint32
+}
+
+func (C *Counter) genOn() {
+	if C.gen == nil {
+		C.gen = make([]uint32, C.len)
+		for rid := range C.gen {
+			C.gen[rid] = C.genMax
+		}
+	}
+}
+
+// GetCounterHandle - Get next available counter as a handle
+func (C *Counter) GetCounterHandle() (CounterHandle, error) {
+	C.genOn()
+	id, err := C.GetCounter()
+	if err != nil {
+		return CounterHandle{ID: -1}, err
+	}
+	return CounterHandle{id, C.gen[id-C.begin]}, nil
+}
+
+// CounterHandleOf - Get the handle of an allocated counter
+// Useful for counters allocated by other means like ReserveCounter
+func (C *Counter) CounterHandleOf(id int) (CounterHandle, error) {
+	if C.IsAllocated(id) == false {
+		return CounterHandle{ID: -1}, errors.New("NotAllocated")
+	}
+	C.genOn()
+	return CounterHandle{id, C.gen[id-C.begin]}, nil
+}
+
+// ValidHandle - Check whether handle refers to the current allocation of
+// its counter
+func (C *Counter) ValidHandle(h CounterHandle) bool {
+	return C.IsAllocated(h.ID) == true && C.gen != nil && C.gen[h.ID-C.begin] == h.Gen
+}
+
+// PutCounterHandle - Return the counter of a handle to the available list
+// Stale handles are rejected
+func (C *Counter) PutCounterHandle(h CounterHandle) error {
+	if C.ValidHandle(h) == false {
+		return errors.New("Stale")
+	}
+	return C.PutCounter(h.ID)
+}
@@ -0,0 +1,120 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright Copyright (c) 2022 NetLOX Inc
+
+package loxilib
+
+import (
+	"time"
+)
+
+// counterHeld - a counter in quarantine, it is let go at until once
+// nAlloc allocations in total have been made from the counter
+type counterHeld struct {
+	rid    int
+	until  time.Time
+	nAlloc int
+}
+
+// counterHold - quarantine state of a counter
+type counterHold struct {
+	delay  time.Duration
+	nAlloc int
+	queue  []counterHeld
+	held   []uint8
+}
+
+// SetQuarantine - Hold returned counters back before they are reused
+// A counter given back with PutCounter becomes available only after delay
+// has passed and also nAlloc further counters have been allocated, both
+// conditions need to hold. Zero value turns off the respective condition,
+// turning off both releases all the held counters. As allocations cannot
+// go on once all the free counters are held, the oldest held counter is
+// let go early when nothing else is free, the delay is always honoured.
+// New settings apply to counters returned from then on
+func (C *Counter) SetQuarantine(delay time.Duration, nAlloc int) {
+	if delay <= 0 && nAlloc <= 0 {
+		if C.hq != nil {
+			for len(C.hq.queue) != 0 {
+				C.unhold()
+			}
+			C.hq = nil
+		}
+		return
+	}
+	if C.hq == nil {
+		C.hq = new(counterHold)
+		C.hq.held = make([]uint8, len(C.allocated))
+	}
+	C.hq.delay = delay
+	C.hq.nAlloc = nAlloc
+}
+
+// SetClock - Set the clock used for quarantine of counters
+// Mainly useful for tests, default is time.Now
+func (C *Counter) SetClock(now func() time.Time) {
+	C.clock = now
+}
+
+func (C *Counter) now() time.Time {
+	if C.clock != nil {
+		return C.clock()
+	}
+	return time.Now()
+}
+
+// Quarantined - Get the number of counters currently held back
+func (C *Counter) Quarantined() int {
+	if C.hq == nil {
+		return 0
+	}
+	return len(C.hq.queue)
+}
+
+func (C *Counter) holdOn() bool {
+	return C.hq != nil
+}
+
+func (C *Counter) isHeld(rid int) bool {
+	return C.hq != nil && IsBitSetInArr(C.hq.held, rid) == true
+}
+
+// hold puts an allocated rid in quarantine, it stays marked allocated in
+// the bitmap so that no allocation path picks it up
+func (C *Counter) hold(rid int) {
+	SetBitInArr(C.hq.held, rid)
+	C.hq.queue = append(C.hq.queue, counterHeld{rid, C.now().Add(C.hq.delay), C.nAlloc + C.hq.nAlloc})
+	C.usageChanged()
+}
+
+// release moves counters whose quarantine is over to the free list
+func (C *Counter) release() {
+	if C.hq == nil || len(C.hq.queue) == 0 {
+		return
+	}
+	now := C.now()
+	for len(C.hq.queue) != 0 {
+		h := C.hq.queue[0]
+		if now.Before(h.until) == true {
+			break
+		}
+		// Held counters would never see nAlloc allocations with nothing
+		// else left to allocate
+		if C.nAlloc < h.nAlloc && C.cap > 0 {
+			break
+		}
+		C.unhold()
+	}
+	// Counters held by a restored snapshot keep quarantine on till they
+	// are all let go
+	if len(C.hq.queue) == 0 && C.hq.delay <= 0 && C.hq.nAlloc <= 0 {
+		C.hq = nil
+	}
+}
+
+// unhold moves the oldest counter in quarantine to the free list
+func (C *Counter) unhold() {
+	rid := C.hq.queue[0].rid
+	C.hq.queue = C.hq.queue[1:]
+	UnSetBitInArr(C.hq.held, rid)
+	C.link(rid)
+}
@@ -0,0 +1,78 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright Copyright (c) 2022 NetLOX Inc
+
+package loxilib
+
+import (
+	"errors"
+)
+
+// CounterThresholdFn - Callback for usage threshold crossings of a counter
+// rising is true when usage goes to or above the threshold and false when it
+// goes back below it
+type CounterThresholdFn func(inUse int, capacity int, rising bool)
+
+type counterThreshold struct {
+	pct   int
+	above bool
+	fn    CounterThresholdFn
+}
+
+// InUse - Get the number of allocated counters
+func (C *Counter) InUse() int {
+	return C.len - C.cap - C.Quarantined()
+}
+
+// Free - Get the number of counters available for allocation
+func (C *Counter) Free() int {
+	return C.cap
+}
+
+// Capacity - Get the total number of counters
+func (C *Counter) Capacity() int {
+	return C.len
+}
+
+// HighWatermark - Get the highest number of counters in use at a time
+func (C *Counter) HighWatermark() int {
+	return C.hwm
+}
+
+// Failures - Get the number of allocations which failed for lack of
+// available counters
+func (C *Counter) Failures() int {
+	return C.fails
+}
+
+// ResetStats - Reset high watermark to current usage and failures to zero
+func (C *Counter) ResetStats() {
+	C.hwm = C.InUse()
+	C.fails = 0
+}
+
+// AddThreshold - Add a callback for usage crossing percent of capacity
+// fn is called from within the counter operation which caused the crossing,
+// so it should not call back into a SyncCounter holding the counter
+// returns nil on success or error
+func (C *Counter) AddThreshold(percent int, fn CounterThresholdFn) error {
+	if percent <= 0 || percent > 100 || fn == nil {
+		return errors.New("Range")
+	}
+	C.thr = append(C.thr, counterThreshold{percent, C.InUse()*100 >= percent*C.len, fn})
+	return nil
+}
+
+// usageChanged updates high watermark and runs threshold callbacks
+func (C *Counter) usageChanged() {
+	inUse := C.InUse()
+	if inUse > C.hwm {
+		C.hwm = inUse
+	}
+	for i := range C.thr {
+		th := &C.thr[i]
+		if above := inUse*100 >= th.pct*C.len; above != th.above {
+			th.above = above
+			th.fn(inUse, C.len, above)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright Copyright (c) 2022 NetLOX Inc
+
+package loxilib
+
+import (
+	"errors"
+)
+
+// Resize - Change the number of counters at runtime
+// Growing adds the new counters at the end of the free list. Shrinking
+// drops counters from the end and succeeds only if none of them is
+// allocated, counters in quarantine are simply dropped
+// returns nil on success or error along with the counters blocking a shrink
+func (C *Counter) Resize(length int) ([]int, error) {
+	if length <= 0 {
+		return nil, errors.New("Range")
+	}
+	if length >= C.len {
+		C.grow(length)
+		C.usageChanged()
+		return nil, nil
+	}
+
+	var busy []int
+	for rid := length; rid < C.len; rid++ {
+		if C.IsAllocated(rid+C.begin) == true {
+			busy = append(busy, rid+C.begin)
+		}
+	}
+	if len(busy) != 0 {
+		return busy, errors.New("Busy")
+	}
+	C.shrink(length)
+	C.usageChanged()
+	return nil, nil
+}
+
+func (C *Counter) grow(length int) {
+	bLen := (length + 7) / 8
+	for rid := C.len; rid < length; rid++ {
+		C.counters = append(C.counters, -1)
+		C.prev = append(C.prev, -1)
+		// Counters coming back after a shrink must not repeat
+		// generations they have handed out before
+		if C.gen != nil {
+			C.gen = append(C.gen, C.genMax)
+		}
+	}
+	for len(C.allocated) < bLen {
+		C.allocated = append(C.allocated, 0)
+		if C.hq != nil {
+			C.hq.held = append(C.hq.held, 0)
+		}
+	}
+	for rid := C.len; rid < length; rid++ {
+		C.linkTail(rid)
+		C.cap++
+	}
+	C.len = length
+}
+
+func (C *Counter) shrink(length int) {
+	for rid := length; rid < C.len; rid++ {
+		if IsBitSetInArr(C.allocated, rid) == false {
+			C.detach(rid)
+			C.cap--
+		}
+	}
+	if C.hq != nil {
+		queue := C.hq.queue[:0]
+		for _, h := range C.hq.queue {
+			if h.rid < length {
+				queue = append(queue, h)
+			}
+		}
+		C.hq.queue = queue
+	}
+
+	bLen := (length + 7) / 8
+	for rid := length; rid < 8*bLen; rid++ {
+		UnSetBitInArr(C.allocated, rid)
+		if C.hq != nil {
+			UnSetBitInArr(C.hq.held, rid)
+		}
+	}
+	C.counters = C.counters[:length]
+	C.prev = C.prev[:length]
+	if C.gen != nil {
+		C.gen = C.gen[:length]
+	}
+	C.allocated = C.allocated[:bLen]
+	if C.hq != nil {
+		C.hq.held = C.hq.held[:bLen]
+	}
+	if C.low > length {
+		C.low = length
+	}
+	C.len = length
+}
@@ -0,0 +1,400 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright Copyright (c) 2022 NetLOX Inc
+
+package loxilib
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"time"
+)
+
+// counterSnapMagic - marker and version at the start of binary snapshots
+// Version 1 snapshots have no generations and version 2 no counters in
+// quarantine
+var counterSnapMagic = []byte{'L', 'X', 'C', 'T', 3}
+
+// CounterSnapshot - Serializable state of a Counter
+// Allocated lists the allocated counters and Free lists the available
+// counters in the order they would be handed out. Held lists the counters
+// in quarantine in the order they were returned. Gen has the generation of
+// every counter when handles are in use and GenMax the highest generation
+// handed out so far
+type CounterSnapshot struct {
+	Begin     int           `json:"begin"`
+	Length    int           `json:"length"`
+	Allocated []int         `json:"allocated"`
+	Free      []int         `json:"free"`
+	Held      []CounterHeld `json:"held,omitempty"`
+	Gen       []uint32      `json:"gen,omitempty"`
+	GenMax    uint32        `json:"genMax,omitempty"`
+}
+
+// CounterHeld - A counter in quarantine in a CounterSnapshot
+// It becomes free at Until once Allocs more counters have been allocated
+type CounterHeld struct {
+	ID     int       `json:"id"`
+	Until  time.Time `json:"until"`
+	Allocs int       `json:"allocs,omitempty"`
+}
+
+// counterFromState builds a counter after checking that allocated bitmap,
+// free list and held list (relative ids) together account for every counter
+// exactly once. nAlloc of held counters is the number of allocations left
+func counterFromState(begin int, length int, allocated []uint8, free []int,
+	held []counterHeld, gen []uint32, genMax uint32) (*Counter, error) {
+	if length <= 0 || len(allocated) != (length+7)/8 || (gen != nil && len(gen) != length) {
+		return nil, errors.New("Corrupt")
+	}
+	for rid := length; rid < 8*len(allocated); rid++ {
+		if IsBitSetInArr(allocated, rid) == true {
+			return nil, errors.New("Corrupt")
+		}
+	}
+	if CountAllSetBitsInArr(allocated)+len(free)+len(held) != length {
+		return nil, errors.New("Corrupt")
+	}
+
+	C := new(Counter)
+	C.begin = begin
+	C.len = length
+	C.cap = len(free)
+	C.start = -1
+	C.end = -1
+	C.counters = make([]int, length)
+	C.prev = make([]int, length)
+	C.allocated = allocated
+	for rid := range C.counters {
+		C.counters[rid] = -1
+		C.prev[rid] = -1
+	}
+
+	seen := make([]uint8, len(allocated))
+	for _, rid := range free {
+		if rid < 0 || rid >= length || IsBitSetInArr(allocated, rid) == true ||
+			IsBitSetInArr(seen, rid) == true {
+			return nil, errors.New("Corrupt")
+		}
+		SetBitInArr(seen, rid)
+		if C.end == -1 {
+			C.start = rid
+		} else {
+			C.counters[C.end] = rid
+			C.prev[rid] = C.end
+		}
+		C.end = rid
+	}
+	if len(held) != 0 {
+		C.hq = new(counterHold)
+		C.hq.held = make([]uint8, len(allocated))
+	}
+	for _, h := range held {
+		if h.rid < 0 || h.rid >= length || IsBitSetInArr(allocated, h.rid) == true ||
+			IsBitSetInArr(seen, h.rid) == true || h.nAlloc < 0 {
+			return nil, errors.New("Corrupt")
+		}
+		SetBitInArr(seen, h.rid)
+		SetBitInArr(allocated, h.rid)
+		SetBitInArr(C.hq.held, h.rid)
+		C.hq.queue = append(C.hq.queue, h)
+	}
+	C.gen = gen
+	C.genMax = genMax
+	for _, g := range gen {
+		if g > C.genMax {
+			C.genMax = g
+		}
+	}
+	C.usageChanged()
+	return C, nil
+}
+
+// freeList returns the free counters in order
+func (C *Counter) freeList() []int {
+	free := make([]int, 0, C.cap)
+	for rid := C.start; rid != -1; rid = C.counters[rid] {
+		free = append(free, rid)
+	}
+	return free
+}
+
+// heldList returns the counters in quarantine in order with the number of
+// allocations they still wait for
+func (C *Counter) heldList() []counterHeld {
+	if C.hq == nil {
+		return nil
+	}
+	held := make([]counterHeld, len(C.hq.queue))
+	for i, h := range C.hq.queue {
+		held[i] = h
+		if held[i].nAlloc -= C.nAlloc; held[i].nAlloc < 0 {
+			held[i].nAlloc = 0
+		}
+	}
+	return held
+}
+
+// allocBits returns the allocation bitmap without counters in quarantine
+func (C *Counter) allocBits() []uint8 {
+	if C.hq == nil {
+		return C.allocated
+	}
+	bits := make([]uint8, len(C.allocated))
+	for i := range bits {
+		bits[i] = C.allocated[i] &^ C.hq.held[i]
+	}
+	return bits
+}
+
+// keepConfig carries over policy, quarantine and threshold settings of C
+// to nC
+func (C *Counter) keepConfig(nC *Counter) {
+	nC.policy, nC.rnd, nC.clock = C.policy, C.rnd, C.clock
+	if C.hq != nil {
+		nC.SetQuarantine(C.hq.delay, C.hq.nAlloc)
+	}
+	nC.thr = C.thr
+	nC.usageChanged()
+}
+
+// Snapshot - Get the state of a counter
+// Allocation policy and quarantine settings are configuration and not part
+// of the snapshot, counters in quarantine are saved with the time and the
+// number of allocations they wait for
+func (C *Counter) Snapshot() *CounterSnapshot {
+	snap := &CounterSnapshot{Begin: C.begin, Length: C.len, GenMax: C.genMax}
+	if C.gen != nil {
+		snap.Gen = append([]uint32(nil), C.gen...)
+	}
+	snap.Allocated = make([]int, 0, C.len-C.cap)
+	for rid := 0; rid < C.len; rid++ {
+		if C.IsAllocated(rid+C.begin) == true {
+			snap.Allocated = append(snap.Allocated, rid+C.begin)
+		}
+	}
+	snap.Free = C.freeList()
+	for i := range snap.Free {
+		snap.Free[i] += C.begin
+	}
+	for _, h := range C.heldList() {
+		snap.Held = append(snap.Held, CounterHeld{h.rid + C.begin, h.until, h.nAlloc})
+	}
+	return snap
+}
+
+// RestoreCounter - Create a counter from its snapshot
+// Counters in quarantine stay held as per the snapshot even though the new
+// counter has no quarantine set
+// returns the counter or error if the snapshot is not consistent
+func RestoreCounter(snap *CounterSnapshot) (*Counter, error) {
+	// Every counter is either allocated or free, checking this before
+	// allocating keeps a bogus length from costing memory
+	if snap == nil || snap.Length <= 0 || len(snap.Allocated) > snap.Length ||
+		len(snap.Free)+len(snap.Held) != snap.Length-len(snap.Allocated) ||
+		(len(snap.Gen) != 0 && len(snap.Gen) != snap.Length) {
+		return nil, errors.New("Corrupt")
+	}
+	allocated := make([]uint8, (snap.Length+7)/8)
+	for _, id := range snap.Allocated {
+		rid := id - snap.Begin
+		if rid < 0 || rid >= snap.Length || IsBitSetInArr(allocated, rid) == true {
+			return nil, errors.New("Corrupt")
+		}
+		SetBitInArr(allocated, rid)
+	}
+	free := make([]int, len(snap.Free))
+	for i, id := range snap.Free {
+		free[i] = id - snap.Begin
+	}
+	held := make([]counterHeld, len(snap.Held))
+	for i, h := range snap.Held {
+		held[i] = counterHeld{h.ID - snap.Begin, h.Until, h.Allocs}
+	}
+	var gen []uint32
+	if len(snap.Gen) != 0 {
+		gen = append(gen, snap.Gen...)
+	}
+	return counterFromState(snap.Begin, snap.Length, allocated, free, held, gen, snap.GenMax)
+}
+
+// MarshalJSON - Encode counter state as JSON
+func (C *Counter) MarshalJSON() ([]byte, error) {
+	return json.Marshal(C.Snapshot())
+}
+
+// UnmarshalJSON - Restore counter state from JSON
+// Allocation policy, quarantine and threshold settings of the counter are
+// kept as is
+func (C *Counter) UnmarshalJSON(data []byte) error {
+	var snap CounterSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+	nC, err := RestoreCounter(&snap)
+	if err != nil {
+		return err
+	}
+	C.keepConfig(nC)
+	*C = *nC
+	return nil
+}
+
+// MarshalBinary - Encode counter state in compact binary form
+// Layout is magic, begin, length, allocated bitmap, free list count, free
+// list, generation count, generations, highest generation, held count and
+// held list as varints followed by a crc32 of everything before it. Each
+// held counter is its id, release time in seconds and nanoseconds and the
+// number of allocations it waits for
+func (C *Counter) MarshalBinary() ([]byte, error) {
+	var tmp [binary.MaxVarintLen64]byte
+
+	free := C.freeList()
+	held := C.heldList()
+	buf := make([]byte, 0, len(counterSnapMagic)+len(C.allocated)+3*binary.MaxVarintLen64+
+		len(free)*3+len(held)*16+4)
+	buf = append(buf, counterSnapMagic...)
+	buf = append(buf, tmp[:binary.PutVarint(tmp[:], int64(C.begin))]...)
+	buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(C.len))]...)
+	buf = append(buf, C.allocBits()...)
+	buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(len(free)))]...)
+	for _, rid := range free {
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(rid))]...)
+	}
+	buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(len(C.gen)))]...)
+	for _, g := range C.gen {
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(g))]...)
+	}
+	buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(C.genMax))]...)
+	buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(len(held)))]...)
+	for _, h := range held {
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(h.rid))]...)
+		buf = append(buf, tmp[:binary.PutVarint(tmp[:], h.until.Unix())]...)
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(h.until.Nanosecond()))]...)
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(h.nAlloc))]...)
+	}
+	binary.BigEndian.PutUint32(tmp[:4], crc32.ChecksumIEEE(buf))
+	return append(buf, tmp[:4]...), nil
+}
+
+// UnmarshalBinary - Restore counter state from its binary form
+// Allocation policy, quarantine and threshold settings of the counter are
+// kept as is
+func (C *Counter) UnmarshalBinary(data []byte) error {
+	corrupt := errors.New("Corrupt")
+
+	mLen := len(counterSnapMagic)
+	if len(data) < mLen+4 || string(data[:mLen-1]) != string(counterSnapMagic[:mLen-1]) ||
+		data[mLen-1] < 1 || data[mLen-1] > counterSnapMagic[mLen-1] {
+		return corrupt
+	}
+	version := data[mLen-1]
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(data[len(data)-4:]) {
+		return corrupt
+	}
+	body = body[len(counterSnapMagic):]
+
+	begin, n := binary.Varint(body)
+	if n <= 0 {
+		return corrupt
+	}
+	body = body[n:]
+	length, n := binary.Uvarint(body)
+	if n <= 0 || length == 0 || length > uint64(len(body))*8 {
+		return corrupt
+	}
+	body = body[n:]
+	aLen := int((length + 7) / 8)
+	if len(body) < aLen {
+		return corrupt
+	}
+	allocated := make([]uint8, aLen)
+	copy(allocated, body[:aLen])
+	body = body[aLen:]
+
+	nFree, n := binary.Uvarint(body)
+	if n <= 0 || nFree > length {
+		return corrupt
+	}
+	body = body[n:]
+	free := make([]int, nFree)
+	for i := range free {
+		rid, n := binary.Uvarint(body)
+		if n <= 0 || rid >= length {
+			return corrupt
+		}
+		free[i] = int(rid)
+		body = body[n:]
+	}
+
+	var gen []uint32
+	var genMax uint64
+	if version >= 2 {
+		nGen, n := binary.Uvarint(body)
+		if n <= 0 || (nGen != 0 && nGen != length) {
+			return corrupt
+		}
+		body = body[n:]
+		if nGen != 0 {
+			gen = make([]uint32, nGen)
+		}
+		for i := range gen {
+			g, n := binary.Uvarint(body)
+			if n <= 0 || g > 0xffffffff {
+				return corrupt
+			}
+			gen[i] = uint32(g)
+			body = body[n:]
+		}
+		if genMax, n = binary.Uvarint(body); n <= 0 || genMax > 0xffffffff {
+			return corrupt
+		}
+		body = body[n:]
+	}
+
+	var held []counterHeld
+	if version >= 3 {
+		nHeld, n := binary.Uvarint(body)
+		if n <= 0 || nHeld > length-nFree {
+			return corrupt
+		}
+		body = body[n:]
+		held = make([]counterHeld, nHeld)
+		for i := range held {
+			rid, n := binary.Uvarint(body)
+			if n <= 0 || rid >= length {
+				return corrupt
+			}
+			body = body[n:]
+			sec, n := binary.Varint(body)
+			if n <= 0 {
+				return corrupt
+			}
+			body = body[n:]
+			nsec, n := binary.Uvarint(body)
+			if n <= 0 || nsec >= uint64(time.Second) {
+				return corrupt
+			}
+			body = body[n:]
+			allocs, n := binary.Uvarint(body)
+			if n <= 0 || allocs > 0x7fffffff {
+				return corrupt
+			}
+			body = body[n:]
+			held[i] = counterHeld{int(rid), time.Unix(sec, int64(nsec)), int(allocs)}
+		}
+	}
+	if len(body) != 0 {
+		return corrupt
+	}
+
+	nC, err := counterFromState(int(begin), int(length), allocated, free, held, gen, uint32(genMax))
+	if err != nil {
+		return err
+	}
+	C.keepConfig(nC)
+	*C = *nC
+	return nil
+}
@@ -4,8 +4,16 @@
 package loxilib
 
 import (
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type Tk struct {
@@ -230,6 +238,46 @@ func TestTrie(t *testing.T) {
 	}
 }
 
+func TestTrieFindInNode(t *testing.T) {
+	trieR := TrieInit(false)
+	for i, route := range []string{"10.0.0.0/8", "10.1.0.0/22", "10.1.4.0/23",
+		"192.168.1.128/25", "192.168.1.192/26", "172.16.0.0/13"} {
+		if ret := trieR.AddTrie(route, i); ret != 0 {
+			t.Fatalf("failed to add %s:%d", route, ret)
+		}
+	}
+	for _, tc := range []struct {
+		ip   string
+		pfx  string
+		data int
+	}{
+		{"10.1.3.200", "10.1.0.0/22", 1},
+		{"10.1.0.1", "10.1.0.0/22", 1},
+		{"10.1.5.9", "10.1.4.0/23", 2},
+		{"10.1.6.1", "10.0.0.0/8", 0},
+		{"192.168.1.130", "192.168.1.128/25", 3},
+		{"192.168.1.250", "192.168.1.192/26", 4},
+		{"172.23.255.1", "172.16.0.0/13", 5},
+	} {
+		ret, ipn, data := trieR.FindTrie(tc.ip)
+		if ret != 0 || ipn.String() != tc.pfx || data != tc.data {
+			t.Fatalf("FindTrie %s got %d:%v:%v expected %s:%d", tc.ip, ret, ipn, data, tc.pfx, tc.data)
+		}
+		if !ipn.IP.Equal(ipn.IP.Mask(ipn.Mask)) {
+			t.Fatalf("FindTrie %s returned unmasked prefix %s", tc.ip, ipn.IP)
+		}
+	}
+	if ret, _, _ := trieR.FindTrie("192.168.1.1"); ret == 0 {
+		t.Fatalf("FindTrie 192.168.1.1 found a route")
+	}
+
+	trieR6 := TrieInit(true)
+	trieR6.AddTrie("2001:db8:a0::/44", 1)
+	if ret, ipn, _ := trieR6.FindTrie("2001:db8:af:1::1"); ret != 0 || ipn.String() != "2001:db8:a0::/44" {
+		t.Fatalf("FindTrie v6 got %d:%v expected 2001:db8:a0::/44", ret, ipn)
+	}
+}
+
 func TestCounter(t *testing.T) {
 
 	cR := NewCounter(0, 10)
@@ -274,3 +322,2269 @@ func TestCounter(t *testing.T) {
 		t.Errorf("Counter get got %d of expected %d", idx, 2)
 	}
 }
+
+func TestTrieBatch(t *testing.T) {
+	trieR := TrieInit(false)
+	routes := []string{"0.0.0.0/0", "10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/23",
+		"10.1.2.128/25", "10.1.2.3/32", "10.1.3.7/32", "192.168.0.0/16", "192.168.10.0/24"}
+	for i, route := range routes {
+		if res := trieR.AddTrie(route, i+1); res != 0 {
+			t.Fatalf("failed to add %s:%d", route, i+1)
+		}
+	}
+
+	r := rand.New(rand.NewSource(1))
+	IPs := make([]net.IP, 600)
+	for i := range IPs {
+		switch i % 3 {
+		case 0:
+			IPs[i] = net.IPv4(10, 1, byte(2+r.Intn(2)), byte(r.Intn(256)))
+		case 1:
+			IPs[i] = net.IPv4(192, 168, byte(r.Intn(16)), byte(r.Intn(256)))
+		default:
+			IPs[i] = net.IPv4(byte(r.Intn(256)), byte(r.Intn(256)), 0, 1)
+		}
+	}
+	IPs = append(IPs, net.ParseIP("2001:db8::1"))
+
+	pfxLens := make([]int, len(IPs))
+	data := make([]TrieData, len(IPs))
+	found := make([]bool, len(IPs))
+	n := trieR.FindTrieBatch(IPs, pfxLens, data, found)
+	if n != len(IPs)-1 {
+		t.Errorf("batch lookup matched %d of %d", n, len(IPs)-1)
+	}
+
+	for i, ip := range IPs[:len(IPs)-1] {
+		ret, ipn, rdata := trieR.FindTrie(ip.String())
+		if ret != 0 || found[i] == false {
+			t.Errorf("batch lookup mismatch for %s", ip)
+			continue
+		}
+		pLen, _ := ipn.Mask.Size()
+		if !ipn.IP.Equal(ip.Mask(ipn.Mask)) {
+			t.Errorf("lookup for %s returned unmasked prefix %s", ip, ipn.String())
+		}
+		if pLen != pfxLens[i] || rdata != data[i] {
+			t.Errorf("batch lookup for %s got /%d:%v expected /%d:%v", ip, pfxLens[i], data[i], pLen, rdata)
+		}
+	}
+	if found[len(IPs)-1] == true {
+		t.Errorf("batch lookup matched v6 address in v4 trie")
+	}
+
+	if trieR.FindTrieBatch(IPs, pfxLens[:1], data, found) >= 0 {
+		t.Errorf("batch lookup accepted short result slices")
+	}
+
+	trieR6 := TrieInit(true)
+	trieR6.AddTrie("2001:db8::/32", 1)
+	trieR6.AddTrie("2001:db8:0:1::/64", 2)
+	IPs6 := []net.IP{net.ParseIP("2001:db8:0:1::5"), net.ParseIP("2001:db8:1::1"), net.ParseIP("2002::1")}
+	n = trieR6.FindTrieBatch(IPs6, pfxLens, data, found)
+	if n != 2 || pfxLens[0] != 64 || data[0] != 2 || pfxLens[1] != 32 || data[1] != 1 || found[2] == true {
+		t.Errorf("v6 batch lookup failed %v %v %v", pfxLens[:3], data[:3], found[:3])
+	}
+
+	// IPv4 addresses in 16 byte form agree with FindTrie
+	trieR6.AddTrie("::/0", 3)
+	IPs6 = []net.IP{net.IPv4(1, 2, 3, 4), net.ParseIP("::ffff:1.2.3.4"), net.ParseIP("2002::1")}
+	n = trieR6.FindTrieBatch(IPs6, pfxLens, data, found)
+	for i, ip := range IPs6 {
+		ret, _, rdata := trieR6.FindTrie(ip.String())
+		if (ret == 0) != found[i] || (ret == 0 && rdata != data[i]) {
+			t.Errorf("v6 batch lookup for %s got %v:%v, FindTrie got %d:%v", ip, found[i], data[i], ret, rdata)
+		}
+	}
+	if n != 1 || found[2] == false || data[2] != 3 {
+		t.Errorf("v6 batch lookup failed %v %v %v", pfxLens[:3], data[:3], found[:3])
+	}
+}
+
+func benchTrieBatchSetup() (*TrieRoot, []net.IP) {
+	trieR := TrieInit(false)
+	for n := 0; n < 1<<16; n++ {
+		trieR.AddTrie(fmt.Sprintf("10.%d.%d.0/24", n>>8&0xff, n&0xff), n+1)
+	}
+	r := rand.New(rand.NewSource(1))
+	IPs := make([]net.IP, TrieBatchMax)
+	for i := range IPs {
+		IPs[i] = net.IPv4(10, byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)))
+	}
+	return trieR, IPs
+}
+
+func BenchmarkTrieFindLoop(b *testing.B) {
+	trieR, IPs := benchTrieBatchSetup()
+	strs := make([]string, len(IPs))
+	for i, ip := range IPs {
+		strs[i] = ip.String()
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, ip := range strs {
+			trieR.FindTrie(ip)
+		}
+	}
+}
+
+func BenchmarkTrieFindBatch(b *testing.B) {
+	trieR, IPs := benchTrieBatchSetup()
+	pfxLens := make([]int, len(IPs))
+	data := make([]TrieData, len(IPs))
+	found := make([]bool, len(IPs))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		trieR.FindTrieBatch(IPs, pfxLens, data, found)
+	}
+}
+
+func trieSetRandom(r *rand.Rand, v6 bool, nPfx int) (*TrieRoot, [256]bool) {
+	var cover [256]bool
+	trieR := TrieInit(v6)
+	for i := 0; i < nPfx; i++ {
+		pLen := 24 + r.Intn(9)
+		last := r.Intn(256) & ^((1 << (32 - pLen)) - 1)
+		var route string
+		if v6 == false {
+			route = fmt.Sprintf("10.0.0.%d/%d", last, pLen)
+		} else {
+			route = fmt.Sprintf("2001:db8::%x/%d", last, pLen+96)
+		}
+		if trieR.AddTrie(route, i+1) != 0 {
+			continue
+		}
+		for a := last; a < last+(1<<(32-pLen)); a++ {
+			cover[a] = true
+		}
+	}
+	return trieR, cover
+}
+
+func trieSetCheck(t *testing.T, op string, trieR *TrieRoot, cover [256]bool) {
+	var ip string
+	for a := 0; a < 256; a++ {
+		if trieR.v6 == false {
+			ip = fmt.Sprintf("10.0.0.%d", a)
+		} else {
+			ip = fmt.Sprintf("2001:db8::%x", a)
+		}
+		ret, _, _ := trieR.FindTrie(ip)
+		if (ret == 0) != cover[a] {
+			t.Errorf("%s: coverage mismatch for %s", op, ip)
+		}
+	}
+
+	// Result must be disjoint with no pair of mergeable siblings
+	pfxs := make(map[trieVar]int)
+	trieR.walkEntriesInt(&trieVar{}, 0, func(tv *trieVar, pfxLen int, data TrieData) bool {
+		pfxs[*tv] = pfxLen
+		return true
+	})
+	for tv, pfxLen := range pfxs {
+		btv := tv
+		if btv.bit(pfxLen-1) == 1 {
+			btv.unSetBit(pfxLen - 1)
+		} else {
+			btv.setBit(pfxLen - 1)
+		}
+		if bLen, ok := pfxs[btv]; ok && bLen == pfxLen {
+			t.Errorf("%s: result is not minimal, %v/%d has its sibling", op, tv.prefix, pfxLen)
+		}
+		if ret, ipn, _ := trieR.FindTrie(trieVar2IPNet(&tv, pfxLen, trieR.v6).IP.String()); ret == 0 {
+			if l, _ := ipn.Mask.Size(); l != pfxLen {
+				t.Errorf("%s: result prefixes overlap at %s", op, ipn.String())
+			}
+		}
+	}
+}
+
+func TestTrieSetOps(t *testing.T) {
+	r := rand.New(rand.NewSource(7))
+	for _, v6 := range []bool{false, true} {
+		for iter := 0; iter < 100; iter++ {
+			t1, c1 := trieSetRandom(r, v6, 1+r.Intn(12))
+			t2, c2 := trieSetRandom(r, v6, 1+r.Intn(12))
+			var cu, ci, cs [256]bool
+			for a := 0; a < 256; a++ {
+				cu[a] = c1[a] || c2[a]
+				ci[a] = c1[a] && c2[a]
+				cs[a] = c1[a] && !c2[a]
+			}
+
+			ret, res := TrieUnion(t1, t2, 1)
+			if ret != 0 {
+				t.Fatalf("union failed %d", ret)
+			}
+			trieSetCheck(t, "union", res, cu)
+
+			ret, res = TrieIntersect(t1, t2, 1)
+			if ret != 0 {
+				t.Fatalf("intersect failed %d", ret)
+			}
+			trieSetCheck(t, "intersect", res, ci)
+
+			ret, res = TrieSubtract(t1, t2, 1)
+			if ret != 0 {
+				t.Fatalf("subtract failed %d", ret)
+			}
+			trieSetCheck(t, "subtract", res, cs)
+		}
+	}
+
+	t1 := TrieInit(false)
+	t1.AddTrie("10.0.0.0/8", 1)
+	t2 := TrieInit(false)
+	t2.AddTrie("10.1.0.0/16", 1)
+	t2.AddTrie("10.255.255.255/32", 1)
+	ret, res := TrieSubtract(t1, t2, 1)
+	if ret != 0 {
+		t.Fatalf("subtract failed %d", ret)
+	}
+	nPfx := 0
+	res.walkEntriesInt(&trieVar{}, 0, func(tv *trieVar, pfxLen int, data TrieData) bool {
+		nPfx++
+		return true
+	})
+	if nPfx != 7+23 {
+		t.Errorf("10.0.0.0/8 minus exceptions produced %d prefixes", nPfx)
+	}
+	if ret, _, _ := res.FindTrie("10.1.2.3"); ret == 0 {
+		t.Errorf("subtracted address still present")
+	}
+	if ret, ipn, _ := res.FindTrie("10.128.0.1"); ret != 0 || ipn.String() != "10.128.0.0/10" {
+		t.Errorf("failed to find 10.128.0.1 in difference")
+	}
+
+	if ret, _ := TrieUnion(t1, TrieInit(true), 1); ret == 0 {
+		t.Errorf("set operation allowed on mixed address families")
+	}
+}
+
+func TestTrieValidateCidrs(t *testing.T) {
+	entries := []TrieCidrEntry{
+		{"10.0.0.0/8", "allow-all"},
+		{"10.1.0.0/16", "svc-a"},
+		{"10.1.2.3/24", "svc-b"},
+		{"10.0.0.0/8", "allow-dup"},
+		{"192.168.1.0/24", "lan"},
+		{"2001:db8::/32", "v6"},
+		{"2001:db8:1::/48", "v6-sub"},
+		{"300.1.1.1/8", "bad"},
+	}
+
+	issues := TrieValidateCidrs(entries)
+	expected := []string{
+		"10.1.2.3/24 (svc-b) has host bits set",
+		"10.0.0.0/8 (allow-dup) duplicates 10.0.0.0/8 (allow-all)",
+		"300.1.1.1/8 (bad) is not a valid cidr",
+		"10.1.0.0/16 (svc-a) is covered by 10.0.0.0/8 (allow-all)",
+		"10.1.2.3/24 (svc-b) is covered by 10.0.0.0/8 (allow-all)",
+		"10.1.2.3/24 (svc-b) is covered by 10.1.0.0/16 (svc-a)",
+		"2001:db8:1::/48 (v6-sub) is covered by 2001:db8::/32 (v6)",
+	}
+	if len(issues) != len(expected) {
+		t.Fatalf("validation reported %d issues expected %d: %v", len(issues), len(expected), issues)
+	}
+	for i, issue := range issues {
+		if issue.String() != expected[i] {
+			t.Errorf("validation issue %d got %q expected %q", i, issue.String(), expected[i])
+		}
+	}
+
+	if issues = TrieValidateCidrs(entries[4:7]); len(issues) != 1 {
+		t.Errorf("validation reported %d issues expected 1", len(issues))
+	}
+
+	// Family comes from the parsed address as in the trie itself
+	for cidr, v6 := range map[string]bool{"10.0.0.0/8": false, "2001:db8::/32": true,
+		"::ffff:10.0.0.0/104": false, "10.0.0.0:/8": false, "::/0": true} {
+		if cidrIsV6(cidr) != v6 {
+			t.Errorf("family of %s is wrong", cidr)
+		}
+	}
+
+	trieR := TrieInit(false)
+	if res := trieR.AddTrie("10.1.2.3/24", 1); res != 0 {
+		t.Errorf("non-strict trie rejected 10.1.2.3/24")
+	}
+	trieR.TrieSetStrict(true)
+	if res := trieR.AddTrie("10.1.3.3/24", 1); res != TrieErrHostBits {
+		t.Errorf("strict trie accepted 10.1.3.3/24 (%d)", res)
+	}
+	if res := trieR.AddTrie("10.1.3.0/24", 1); res != 0 {
+		t.Errorf("strict trie rejected 10.1.3.0/24 (%d)", res)
+	}
+}
+
+func TestSubnetAlloc(t *testing.T) {
+	sA, err := NewSubnetAlloc("10.244.0.0/16")
+	if err != nil {
+		t.Fatalf("failed to create subnet allocator %s", err)
+	}
+
+	expected := []string{"10.244.0.0/24", "10.244.1.0/24", "10.244.2.0/23", "10.244.4.0/24"}
+	lens := []int{24, 24, 23, 24}
+	for i, pLen := range lens {
+		ipn, err := sA.AllocSubnet(pLen, fmt.Sprintf("node%d", i))
+		if err != nil || ipn.String() != expected[i] {
+			t.Errorf("subnet alloc /%d got %v expected %s", pLen, ipn, expected[i])
+		}
+	}
+
+	if err := sA.ReserveSubnet("10.244.128.0/20", "svc"); err != nil {
+		t.Errorf("failed to reserve 10.244.128.0/20 %s", err)
+	}
+	if err := sA.ReserveSubnet("10.244.130.0/24", "svc"); err == nil {
+		t.Errorf("reserved busy subnet 10.244.130.0/24")
+	}
+	if err := sA.ReserveSubnet("10.245.0.0/24", "svc"); err == nil {
+		t.Errorf("reserved subnet outside parent")
+	}
+	if err := sA.ReserveSubnet("10.244.5.1/24", "svc"); err == nil {
+		t.Errorf("reserved non-canonical subnet")
+	}
+
+	ipn, owner, err := sA.FindSubnetOwner("10.244.3.7")
+	if err != nil || ipn.String() != "10.244.2.0/23" || owner != "node2" {
+		t.Errorf("owner lookup for 10.244.3.7 got %v:%v", ipn, owner)
+	}
+	ipn, owner, err = sA.FindSubnetOwner("10.244.140.1")
+	if err != nil || ipn.String() != "10.244.128.0/20" || owner != "svc" {
+		t.Errorf("owner lookup for 10.244.140.1 got %v:%v", ipn, owner)
+	}
+	if _, _, err = sA.FindSubnetOwner("10.244.200.1"); err == nil {
+		t.Errorf("owner found for free address")
+	}
+
+	if err := sA.ReleaseSubnet("10.244.1.0/24"); err != nil {
+		t.Errorf("failed to release 10.244.1.0/24 %s", err)
+	}
+	if err := sA.ReleaseSubnet("10.244.1.0/24"); err == nil {
+		t.Errorf("released 10.244.1.0/24 twice")
+	}
+	ipn, err = sA.AllocSubnet(24, "node5")
+	if err != nil || ipn.String() != "10.244.1.0/24" {
+		t.Errorf("subnet alloc did not reuse smallest free block, got %v", ipn)
+	}
+
+	for _, cidr := range []string{"10.244.0.0/24", "10.244.1.0/24", "10.244.2.0/23",
+		"10.244.4.0/24", "10.244.128.0/20"} {
+		if err := sA.ReleaseSubnet(cidr); err != nil {
+			t.Errorf("failed to release %s %s", cidr, err)
+		}
+	}
+	cnt := sA.SubnetFreeCount()
+	for l, n := range cnt {
+		if (l == 16 && n != 1) || (l != 16 && n != 0) {
+			t.Errorf("free blocks not coalesced, /%d has %d blocks", l, n)
+		}
+	}
+
+	if _, err = sA.AllocSubnet(15, "big"); err == nil {
+		t.Errorf("allocated subnet larger than parent")
+	}
+	if _, err = sA.AllocSubnet(16, "all"); err != nil {
+		t.Errorf("failed to allocate whole parent %s", err)
+	}
+	if _, err = sA.AllocSubnet(30, "none"); err == nil {
+		t.Errorf("allocated subnet from exhausted parent")
+	}
+
+	// Free blocks of the same size go out lowest address first
+	sA, _ = NewSubnetAlloc("10.0.0.0/24")
+	for i := 0; i < 4; i++ {
+		sA.AllocSubnet(26, i)
+	}
+	sA.ReleaseSubnet("10.0.0.192/26")
+	sA.ReleaseSubnet("10.0.0.64/26")
+	for _, exp := range []string{"10.0.0.64/26", "10.0.0.192/26"} {
+		if ipn, err := sA.AllocSubnet(26, "again"); err != nil || ipn.String() != exp {
+			t.Errorf("subnet alloc got %v expected %s", ipn, exp)
+		}
+	}
+
+	sA6, err := NewSubnetAlloc("fd00:10::/48")
+	if err != nil {
+		t.Fatalf("failed to create v6 subnet allocator %s", err)
+	}
+	sA6.ReserveSubnet("fd00:10::/64", "rsvd")
+	ipn, err = sA6.AllocSubnet(64, "node0")
+	if err != nil || ipn.String() != "fd00:10:0:1::/64" {
+		t.Errorf("v6 subnet alloc got %v", ipn)
+	}
+	if _, owner, err = sA6.FindSubnetOwner("fd00:10:0:1::1"); err != nil || owner != "node0" {
+		t.Errorf("v6 owner lookup got %v", owner)
+	}
+}
+
+func TestTrieExpiry(t *testing.T) {
+	now := time.Unix(1000, 0)
+	trieR := TrieInit(false)
+	trieR.TrieSetClock(func() time.Time { return now })
+	expired := make(map[string]TrieData)
+	trieR.TrieSetExpiryNotify(func(ipn *net.IPNet, data TrieData) {
+		expired[ipn.String()] = data
+	})
+
+	trieR.AddTrie("10.0.0.0/8", 1)
+	for i := 0; i < 5; i++ {
+		route := fmt.Sprintf("10.1.%d.0/24", i)
+		if res := trieR.AddTrieTTL(route, i+10, time.Duration(i+1)*time.Second); res != 0 {
+			t.Errorf("failed to add %s with ttl", route)
+		}
+	}
+	if res := trieR.AddTrieDeadline("192.168.0.0/16", 20, now.Add(10*time.Second)); res != 0 {
+		t.Errorf("failed to add 192.168.0.0/16 with deadline")
+	}
+	if res := trieR.AddTrieTTL("10.1.0.0/24", 1, time.Second); res != TrieErrExists {
+		t.Errorf("re-added 10.1.0.0/24 with ttl")
+	}
+
+	if n := trieR.SweepTrie(0); n != 0 {
+		t.Errorf("sweep removed %d entries before expiry", n)
+	}
+	if d, ok := trieR.TrieNextExpiry(); !ok || !d.Equal(now.Add(time.Second)) {
+		t.Errorf("next expiry got %v", d)
+	}
+
+	if res := trieR.RefreshTrie("10.1.0.0/24", 30*time.Second); res != 0 {
+		t.Errorf("failed to refresh 10.1.0.0/24")
+	}
+	if res := trieR.RefreshTrie("10.9.0.0/24", 30*time.Second); res != TrieErrNoEnt {
+		t.Errorf("refreshed absent entry")
+	}
+	if res := trieR.DelTrie("10.1.4.0/24"); res != 0 {
+		t.Errorf("failed to delete 10.1.4.0/24")
+	}
+
+	now = now.Add(4 * time.Second)
+	if n := trieR.SweepTrie(2); n != 2 {
+		t.Errorf("bounded sweep removed %d entries", n)
+	}
+	if n := trieR.SweepTrie(2); n != 1 {
+		t.Errorf("second sweep removed %d entries", n)
+	}
+	if len(expired) != 3 || expired["10.1.1.0/24"] != 11 || expired["10.1.3.0/24"] != 13 {
+		t.Errorf("unexpected expiry notifications %v", expired)
+	}
+	if _, ipn, _ := trieR.FindTrie("10.1.2.1"); ipn == nil || ipn.String() != "10.0.0.0/8" {
+		t.Errorf("expired entry 10.1.2.0/24 still matches")
+	}
+	if _, ipn, _ := trieR.FindTrie("10.1.0.1"); ipn == nil || ipn.String() != "10.1.0.0/24" {
+		t.Errorf("refreshed entry 10.1.0.0/24 was removed")
+	}
+
+	now = now.Add(time.Minute)
+	if n := trieR.SweepTrie(0); n != 2 {
+		t.Errorf("final sweep removed %d entries", n)
+	}
+	if _, ok := trieR.TrieNextExpiry(); ok {
+		t.Errorf("expiring entries left after final sweep")
+	}
+	if ret, ipn, _ := trieR.FindTrie("10.200.0.1"); ret != 0 || ipn.String() != "10.0.0.0/8" {
+		t.Errorf("permanent entry 10.0.0.0/8 was removed")
+	}
+}
+
+func trieEntries(trieR *TrieRoot) map[string]TrieData {
+	ents := make(map[string]TrieData)
+	trieR.walkEntriesInt(&trieVar{}, 0, func(tv *trieVar, pfxLen int, data TrieData) bool {
+		ents[trieVar2IPNet(tv, pfxLen, trieR.v6).String()] = data
+		return true
+	})
+	return ents
+}
+
+func TestTrieCloneClear(t *testing.T) {
+	trieR := TrieInit(false)
+	routes := []string{"0.0.0.0/0", "10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/23", "10.1.2.3/32"}
+	for i, route := range routes {
+		trieR.AddTrie(route, i+1)
+	}
+	now := time.Unix(1000, 0)
+	trieR.TrieSetClock(func() time.Time { return now })
+	trieR.AddTrieTTL("172.16.0.0/12", 100, time.Second)
+
+	cloneR := trieR.CloneTrie(func(d TrieData) TrieData { return d.(int) * 10 })
+	ents := trieEntries(cloneR)
+	if len(ents) != len(routes)+1 || ents["10.1.2.0/23"] != 40 || ents["172.16.0.0/12"] != 1000 {
+		t.Errorf("clone has unexpected entries %v", ents)
+	}
+
+	trieR.DelTrie("10.1.2.3/32")
+	trieR.AddTrie("10.1.2.4/32", 6)
+	if ret, ipn, data := cloneR.FindTrie("10.1.2.3"); ret != 0 || ipn.String() != "10.1.2.3/32" || data != 50 {
+		t.Errorf("clone changed with its source")
+	}
+	if ret, ipn, _ := cloneR.FindTrie("10.1.2.4"); ret != 0 || ipn.String() != "10.1.2.0/23" {
+		t.Errorf("clone changed with its source")
+	}
+
+	now = now.Add(time.Minute)
+	if n := cloneR.SweepTrie(0); n != 1 {
+		t.Errorf("clone did not retain expiry, swept %d", n)
+	}
+
+	trieR.ClearTrie()
+	if ents = trieEntries(trieR); len(ents) != 0 {
+		t.Errorf("cleared trie has entries %v", ents)
+	}
+	if ret, _, _ := trieR.FindTrie("10.1.2.3"); ret == 0 {
+		t.Errorf("cleared trie has matches")
+	}
+	if n := trieR.SweepTrie(0); n != 0 {
+		t.Errorf("cleared trie swept %d entries", n)
+	}
+	if res := trieR.AddTrie("10.0.0.0/8", 1); res != 0 {
+		t.Errorf("failed to add to cleared trie")
+	}
+	if ret, _, _ := cloneR.FindTrie("10.1.2.3"); ret != 0 {
+		t.Errorf("clear affected clone")
+	}
+}
+
+func TestTrieBulkLoad(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	var entries []TrieBulkEntry
+	for i := 0; i < 3000; i++ {
+		pLen := r.Intn(33)
+		ip := net.IPv4(10, byte(r.Intn(4)), byte(r.Intn(256)), byte(r.Intn(256)))
+		ipn := net.IPNet{IP: ip.Mask(net.CIDRMask(pLen, 32)), Mask: net.CIDRMask(pLen, 32)}
+		entries = append(entries, TrieBulkEntry{ipn.String(), i + 1})
+	}
+	entries = append(entries, TrieBulkEntry{"10.0.0.0/33", 1})
+
+	addR := TrieInit(false)
+	addR.AddTrie("10.2.0.0/16", 1)
+	bulkR := TrieInit(false)
+	bulkR.AddTrie("10.2.0.0/16", 1)
+
+	failed := 0
+	for i, e := range entries {
+		if addR.AddTrie(e.Cidr, e.Data) != 0 {
+			failed++
+			entries[i].Data = -1
+		}
+	}
+
+	res := bulkR.BulkLoadTrie(entries)
+	if res.Added != len(entries)-failed || len(res.Failed) != failed {
+		t.Errorf("bulk load added %d failed %d expected %d/%d", res.Added, len(res.Failed),
+			len(entries)-failed, failed)
+	}
+	for i, e := range entries {
+		if _, ok := res.Failed[i]; ok != (e.Data == -1) {
+			t.Errorf("bulk load failure mismatch for %s", e.Cidr)
+		}
+	}
+	if res.Failed[len(entries)-1] != TrieErrPrefix {
+		t.Errorf("bulk load did not report invalid prefix")
+	}
+
+	addEnts := trieEntries(addR)
+	bulkEnts := trieEntries(bulkR)
+	if len(addEnts) != len(bulkEnts) {
+		t.Errorf("bulk load has %d entries expected %d", len(bulkEnts), len(addEnts))
+	}
+	for k, v := range addEnts {
+		if bulkEnts[k] != v {
+			t.Errorf("bulk load entry %s got %v expected %v", k, bulkEnts[k], v)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		ip := net.IPv4(10, byte(r.Intn(4)), byte(r.Intn(256)), byte(r.Intn(256))).String()
+		ret1, ipn1, data1 := addR.FindTrie(ip)
+		ret2, ipn2, data2 := bulkR.FindTrie(ip)
+		if ret1 != ret2 || data1 != data2 || (ret1 == 0 && ipn1.String() != ipn2.String()) {
+			t.Errorf("bulk loaded trie lookup mismatch for %s", ip)
+		}
+	}
+
+	// Entries are deletable as usual
+	for k := range bulkEnts {
+		if res := bulkR.DelTrie(k); res != 0 {
+			t.Errorf("failed to delete bulk loaded %s", k)
+		}
+	}
+	if ents := trieEntries(bulkR); len(ents) != 0 {
+		t.Errorf("bulk loaded trie not empty after deletes")
+	}
+}
+
+func benchTrieBulkEntries() []TrieBulkEntry {
+	entries := make([]TrieBulkEntry, 1<<16)
+	for n := range entries {
+		entries[n] = TrieBulkEntry{fmt.Sprintf("10.%d.%d.0/24", n>>8&0xff, n&0xff), n + 1}
+	}
+	return entries
+}
+
+func BenchmarkTrieAddLoop(b *testing.B) {
+	entries := benchTrieBulkEntries()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		trieR := TrieInit(false)
+		for _, e := range entries {
+			trieR.AddTrie(e.Cidr, e.Data)
+		}
+	}
+}
+
+func BenchmarkTrieAddLoop6(b *testing.B) {
+	cidrs := make([]string, 1<<16)
+	for n := range cidrs {
+		cidrs[n] = fmt.Sprintf("2001:db8:%x:%x::/64", n>>8&0xff, n&0xff)
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		trieR := TrieInit(true)
+		for i, cidr := range cidrs {
+			trieR.AddTrie(cidr, i)
+		}
+	}
+}
+
+func BenchmarkTrieFindLoop6(b *testing.B) {
+	r := rand.New(rand.NewSource(26))
+	trieR := TrieInit(true)
+	for n := 0; n < 1<<12; n++ {
+		trieR.AddTrie(fmt.Sprintf("2001:db8:%x:%x::/64", n>>8&0xff, n&0xff), n)
+	}
+	strs := make([]string, 1<<12)
+	for i := range strs {
+		strs[i] = fmt.Sprintf("2001:db8:%x:%x::%x", r.Intn(16), r.Intn(256), r.Intn(1<<16))
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, ip := range strs {
+			trieR.FindTrie(ip)
+		}
+	}
+}
+
+func BenchmarkTrieBulkLoad(b *testing.B) {
+	entries := benchTrieBulkEntries()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		trieR := TrieInit(false)
+		trieR.BulkLoadTrie(entries)
+	}
+}
+
+type tNextHop struct {
+	gw    string
+	iface string
+}
+
+func TestTrieRevIndex(t *testing.T) {
+	trieR := TrieInit(false)
+	nh1 := &tNextHop{"10.0.0.1", "eth0"}
+	nh2 := &tNextHop{"10.0.0.2", "eth1"}
+	trieR.AddTrie("0.0.0.0/0", nh1)
+	trieR.AddTrie("192.168.0.0/16", nh2)
+
+	trieR.TrieEnableRevIndex(func(d TrieData) interface{} { return d.(*tNextHop).gw })
+	for i := 0; i < 20; i++ {
+		nh := nh1
+		if i%2 == 1 {
+			nh = nh2
+		}
+		trieR.AddTrie(fmt.Sprintf("172.16.%d.0/24", i), nh)
+	}
+	res := trieR.BulkLoadTrie([]TrieBulkEntry{{"10.10.0.0/16", nh2}, {"10.20.0.0/16", nh2}, {"10.20.0.0/16", nh1}})
+	if res.Added != 2 {
+		t.Errorf("bulk load added %d", res.Added)
+	}
+
+	if pfxs := trieR.FindTrieByData("10.0.0.1"); len(pfxs) != 11 {
+		t.Errorf("reverse index has %d prefixes for 10.0.0.1", len(pfxs))
+	}
+	if pfxs := trieR.FindTrieByData("10.0.0.2"); len(pfxs) != 13 {
+		t.Errorf("reverse index has %d prefixes for 10.0.0.2", len(pfxs))
+	}
+
+	trieR.DelTrie("172.16.1.0/24")
+	trieR.DelTrie("172.16.40.0/24")
+	if pfxs := trieR.FindTrieByData("10.0.0.2"); len(pfxs) != 12 {
+		t.Errorf("reverse index has %d prefixes for 10.0.0.2 after delete", len(pfxs))
+	}
+
+	cloneR := trieR.CloneTrie(nil)
+
+	if n := trieR.DelTrieByData("10.0.0.2"); n != 12 {
+		t.Errorf("deleted %d prefixes for 10.0.0.2", n)
+	}
+	if pfxs := trieR.FindTrieByData("10.0.0.2"); len(pfxs) != 0 {
+		t.Errorf("prefixes for 10.0.0.2 remain after delete %v", pfxs)
+	}
+	if _, _, data := trieR.FindTrie("192.168.1.1"); data != nh1 {
+		t.Errorf("route via deleted next hop still matches")
+	}
+	if _, _, data := trieR.FindTrie("172.16.2.1"); data != nh1 {
+		t.Errorf("route via other next hop was deleted")
+	}
+	if n := trieR.DelTrieByData("10.0.0.9"); n != 0 {
+		t.Errorf("deleted %d prefixes for unknown next hop", n)
+	}
+
+	if pfxs := cloneR.FindTrieByData("10.0.0.2"); len(pfxs) != 12 {
+		t.Errorf("clone reverse index has %d prefixes for 10.0.0.2", len(pfxs))
+	}
+
+	trieR.ClearTrie()
+	if pfxs := trieR.FindTrieByData("10.0.0.1"); len(pfxs) != 0 {
+		t.Errorf("cleared trie reverse index has %v", pfxs)
+	}
+	trieR.AddTrie("10.0.0.0/8", nh1)
+	if pfxs := trieR.FindTrieByData("10.0.0.1"); len(pfxs) != 1 || pfxs[0].String() != "10.0.0.0/8" {
+		t.Errorf("reverse index not maintained after clear %v", pfxs)
+	}
+
+	if TrieInit(false).DelTrieByData("x") >= 0 {
+		t.Errorf("delete by data worked without reverse index")
+	}
+
+	// Without key function data is the key, prefixes come out in order
+	trieR = TrieInit(false)
+	trieR.TrieEnableRevIndex(nil)
+	for _, route := range []string{"10.1.0.0/16", "172.16.0.0/12", "10.0.0.0/16", "10.0.0.0/8"} {
+		trieR.AddTrie(route, "gw")
+	}
+	if pfxs := trieR.FindTrieByData("gw"); fmt.Sprint(pfxs) != "[10.0.0.0/8 10.0.0.0/16 10.1.0.0/16 172.16.0.0/12]" {
+		t.Errorf("reverse index by data got %v", pfxs)
+	}
+}
+
+func classRandRule(r *rand.Rand, id int, v6 bool) ClassRule {
+	randCidr := func() string {
+		pLen := 24 + r.Intn(9)
+		last := r.Intn(8) & ^((1 << (32 - pLen)) - 1)
+		if r.Intn(8) == 0 {
+			pLen, last = 0, 0
+		}
+		if v6 == true {
+			return fmt.Sprintf("2001:db8::%x/%d", last, pLen+96*btoi(pLen != 0))
+		}
+		return fmt.Sprintf("10.0.0.%d/%d", last, pLen)
+	}
+	rule := ClassRule{ID: id, Priority: r.Intn(10), SrcCidr: randCidr(), DstCidr: randCidr()}
+	if r.Intn(2) == 0 {
+		rule.Proto = 6 + 11*r.Intn(2)
+	}
+	if r.Intn(2) == 0 {
+		rule.DPortMin = 1 + r.Intn(8)
+		rule.DPortMax = rule.DPortMin + r.Intn(4)
+	}
+	if r.Intn(4) == 0 {
+		rule.SPortMin = 1 + r.Intn(8)
+		rule.SPortMax = rule.SPortMin + r.Intn(4)
+	}
+	return rule
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func classOracle(rules map[int]ClassRule, pkt ClassPkt) *ClassRule {
+	var best *ClassRule
+	for id := range rules {
+		rule := rules[id]
+		_, sNet, _ := net.ParseCIDR(rule.SrcCidr)
+		_, dNet, _ := net.ParseCIDR(rule.DstCidr)
+		if !sNet.Contains(pkt.SrcIP) || !dNet.Contains(pkt.DstIP) || !rule.match(&pkt) {
+			continue
+		}
+		if classRuleBetter(&rule, best) {
+			best = &rule
+		}
+	}
+	return best
+}
+
+func TestClassifier(t *testing.T) {
+	r := rand.New(rand.NewSource(5))
+	for _, v6 := range []bool{false, true} {
+		C := NewClassifier(v6)
+		rules := make(map[int]ClassRule)
+		for id := 0; id < 200; id++ {
+			if id > 0 && r.Intn(3) == 0 {
+				for did := range rules {
+					if err := C.DelClassRule(did); err != nil {
+						t.Errorf("failed to delete rule %d", did)
+					}
+					delete(rules, did)
+					break
+				}
+			}
+			rule := classRandRule(r, id, v6)
+			if err := C.AddClassRule(rule); err != nil {
+				t.Fatalf("failed to add rule %v: %s", rule, err)
+			}
+			rules[id] = rule
+
+			for p := 0; p < 10; p++ {
+				pkt := ClassPkt{Proto: []int{6, 17, 1}[r.Intn(3)], SPort: r.Intn(12), DPort: r.Intn(12)}
+				if v6 == true {
+					pkt.SrcIP = net.ParseIP(fmt.Sprintf("2001:db8::%x", r.Intn(8)))
+					pkt.DstIP = net.ParseIP(fmt.Sprintf("2001:db8::%x", r.Intn(8)))
+				} else {
+					pkt.SrcIP = net.IPv4(10, 0, 0, byte(r.Intn(8)))
+					pkt.DstIP = net.IPv4(10, 0, 0, byte(r.Intn(8)))
+				}
+				got := C.Classify(pkt)
+				exp := classOracle(rules, pkt)
+				if (got == nil) != (exp == nil) || (got != nil && got.ID != exp.ID) {
+					t.Fatalf("classify %v got %v expected %v", pkt, got, exp)
+				}
+			}
+		}
+		for id := range rules {
+			if err := C.DelClassRule(id); err != nil {
+				t.Errorf("failed to delete rule %d", id)
+			}
+		}
+		if ents := trieEntries(C.src); len(ents) != 0 {
+			t.Errorf("classifier source trie not empty after deleting all rules")
+		}
+	}
+
+	C := NewClassifier(false)
+	if err := C.AddClassRule(ClassRule{ID: 1, SrcCidr: "2001:db8::/32", DstCidr: "0.0.0.0/0"}); err == nil {
+		t.Errorf("classifier accepted rule of wrong family")
+	}
+	C.AddClassRule(ClassRule{ID: 1, SrcCidr: "0.0.0.0/0", DstCidr: "0.0.0.0/0"})
+	if err := C.AddClassRule(ClassRule{ID: 1, SrcCidr: "0.0.0.0/0", DstCidr: "0.0.0.0/0"}); err == nil {
+		t.Errorf("classifier accepted duplicate rule ID")
+	}
+	for _, rule := range []ClassRule{{ID: 2, SrcCidr: "0.0.0.0/0", DstCidr: "0.0.0.0/0", SPortMin: 20, SPortMax: 10},
+		{ID: 3, SrcCidr: "0.0.0.0/0", DstCidr: "0.0.0.0/0", DPortMax: 80, DPortMin: 443}} {
+		if err := C.AddClassRule(rule); err == nil || err.Error() != "Range" {
+			t.Errorf("classifier accepted inverted port range %v", err)
+		}
+	}
+	if err := C.DelClassRule(2); err == nil {
+		t.Errorf("classifier deleted unknown rule")
+	}
+}
+
+func TestTrieKey(t *testing.T) {
+	// MAC OUI lookup on 48-bit keys
+	macR := TrieInitKey(48)
+	ouis := map[string]string{"00:1b:21": "intel", "3c:fd:fe": "intel", "00:50:56": "vmware"}
+	for oui, vendor := range ouis {
+		hw, _ := net.ParseMAC(oui + ":00:00:00")
+		if res := macR.AddTrieKey(hw, 24, vendor); res != 0 {
+			t.Errorf("failed to add oui %s", oui)
+		}
+	}
+	hw, _ := net.ParseMAC("00:50:56:00:00:00")
+	if res := macR.AddTrieKey(hw, 48, "vm-gw"); res != 0 {
+		t.Errorf("failed to add full mac")
+	}
+	hw, _ = net.ParseMAC("00:50:56:ab:cd:ef")
+	if ret, pLen, data := macR.FindTrieKey(hw); ret != 0 || pLen != 24 || data != "vmware" {
+		t.Errorf("mac lookup got %d /%d %v", ret, pLen, data)
+	}
+	hw, _ = net.ParseMAC("00:50:56:00:00:00")
+	if ret, pLen, data := macR.FindTrieKey(hw); ret != 0 || pLen != 48 || data != "vm-gw" {
+		t.Errorf("mac lookup got %d /%d %v", ret, pLen, data)
+	}
+	hw, _ = net.ParseMAC("00:50:57:00:00:00")
+	if ret, _, _ := macR.FindTrieKey(hw); ret != TrieErrNoEnt {
+		t.Errorf("mac lookup matched unknown oui")
+	}
+	if ret, _, _ := macR.FindTrieKey(hw[:4]); ret != TrieErrPrefix {
+		t.Errorf("mac lookup accepted short key")
+	}
+
+	// MPLS labels are 20 bits, match a label block with a 12 bit prefix
+	mplsR := TrieInitKey(20)
+	mplsR.AddTrieKey([]byte{0x10, 0x00}, 12, "block-256")
+	if ret, pLen, data := mplsR.FindTrieKey([]byte{0x10, 0x0a, 0x50}); ret != 0 || pLen != 12 || data != "block-256" {
+		t.Errorf("mpls lookup got %d /%d %v", ret, pLen, data)
+	}
+	if res := mplsR.AddTrieKey([]byte{0x10, 0x0a, 0x50}, 24, 1); res != TrieErrPrefix {
+		t.Errorf("added prefix longer than max key bits")
+	}
+
+	// VLAN + IPv4 composite key with host bits in prefix
+	compR := TrieInitKey(48)
+	compR.TrieSetStrict(true)
+	if res := compR.AddTrieKey([]byte{0x00, 0x64, 10, 1, 2, 3}, 40, 1); res != TrieErrHostBits {
+		t.Errorf("strict key trie accepted host bits")
+	}
+	compR.TrieSetStrict(false)
+	compR.AddTrieKey([]byte{0x00, 0x64, 10, 1, 2, 3}, 40, 100)
+	compR.AddTrieKey([]byte{0x00, 0x65, 10}, 24, 101)
+	if ret, pLen, data := compR.FindTrieKey([]byte{0x00, 0x64, 10, 1, 2, 77}); ret != 0 || pLen != 40 || data != 100 {
+		t.Errorf("composite lookup got %d /%d %v", ret, pLen, data)
+	}
+	if ret, _, _ := compR.FindTrieKey([]byte{0x00, 0x66, 10, 1, 2, 77}); ret == 0 {
+		t.Errorf("composite lookup matched wrong vlan")
+	}
+	if res := compR.DelTrieKey([]byte{0x00, 0x64, 10, 1, 2}, 40); res != 0 {
+		t.Errorf("failed to delete composite key")
+	}
+	if res := compR.DelTrieKey([]byte{0x00, 0x64, 10, 1, 2}, 40); res != TrieErrNoEnt {
+		t.Errorf("deleted composite key twice")
+	}
+	if res := compR.AddTrie("10.0.0.0/8", 1); res != TrieErrPrefix {
+		t.Errorf("added cidr to key trie")
+	}
+
+	// Long byte strings up to the max key length
+	strR := TrieInitKey(8 * TrieMaxKeyLen)
+	key := make([]byte, TrieMaxKeyLen)
+	copy(key, "service/default/frontend")
+	strR.AddTrieKey([]byte("service/"), 64, "svc")
+	strR.AddTrieKey(key, 8*TrieMaxKeyLen, "exact")
+	if ret, pLen, data := strR.FindTrieKey(key); ret != 0 || pLen != 8*TrieMaxKeyLen || data != "exact" {
+		t.Errorf("string lookup got %d /%d %v", ret, pLen, data)
+	}
+	key[TrieMaxKeyLen-1] = 1
+	if ret, pLen, data := strR.FindTrieKey(key); ret != 0 || pLen != 64 || data != "svc" {
+		t.Errorf("string lookup got %d /%d %v", ret, pLen, data)
+	}
+	if TrieInitKey(8*TrieMaxKeyLen+1) != nil {
+		t.Errorf("created key trie beyond max key length")
+	}
+}
+
+func TestAddrRegistry(t *testing.T) {
+	R := NewAddrRegistry()
+	tests := []struct {
+		ip     string
+		name   string
+		fwd    bool
+		global bool
+	}{
+		{"10.1.2.3", "Private-Use", true, false},
+		{"100.100.1.1", "Shared Address Space", true, false},
+		{"127.0.0.1", "Loopback", false, false},
+		{"169.254.10.1", "Link Local", false, false},
+		{"192.0.0.9", "Port Control Protocol Anycast", true, true},
+		{"192.0.0.100", "IETF Protocol Assignments", false, false},
+		{"198.51.100.7", "Documentation (TEST-NET-2)", false, false},
+		{"224.0.0.5", "Local Network Control Block", false, false},
+		{"239.1.1.1", "Multicast", true, true},
+		{"255.255.255.255", "Limited Broadcast", false, false},
+		{"::1", "Loopback Address", false, false},
+		{"::ffff:10.1.1.1", "IPv4-mapped Address", false, false},
+		{"2001:db8::1", "Documentation", false, false},
+		{"2001:1::2", "Traversal Using Relays around NAT Anycast", true, true},
+		{"2001:0:1::1", "TEREDO", true, false},
+		{"2001:100::1", "IETF Protocol Assignments", false, false},
+		{"fd12:3456::1", "Unique-Local", true, false},
+		{"fe80::1", "Link-Local Unicast", false, false},
+		{"ff02::1", "Multicast", true, true},
+	}
+	for _, tc := range tests {
+		blk := R.FindAddrBlock(tc.ip)
+		if blk == nil || blk.Name != tc.name || blk.Forwardable != tc.fwd || blk.Global != tc.global {
+			t.Errorf("classify %s got %v expected %s", tc.ip, blk, tc.name)
+		}
+	}
+	for _, ip := range []string{"8.8.8.8", "2606:4700::1111"} {
+		if blk := R.FindAddrBlock(ip); blk != nil {
+			t.Errorf("classify %s got %v for global unicast", ip, blk)
+		}
+	}
+
+	if res := R.AddAddrBlock(AddrBlockInfo{Cidr: "10.200.0.0/16", Name: "Site Mgmt",
+		RFC: "local", Source: true, Destination: true}); res != 0 {
+		t.Errorf("failed to add custom block")
+	}
+	if blk := R.FindAddrBlock("10.200.3.4"); blk == nil || blk.Name != "Site Mgmt" {
+		t.Errorf("custom block not found got %v", blk)
+	}
+	if blk := R.FindAddrBlock("10.201.3.4"); blk == nil || blk.Name != "Private-Use" {
+		t.Errorf("private block not found got %v", blk)
+	}
+	if res := R.AddAddrBlock(AddrBlockInfo{Cidr: "10.0.0.0/8", Name: "dup"}); res == 0 {
+		t.Errorf("added duplicate block")
+	}
+	if res := R.DelAddrBlock("10.200.0.0/16"); res != 0 {
+		t.Errorf("failed to delete custom block")
+	}
+	if blk := R.FindAddrBlock("10.200.3.4"); blk == nil || blk.Name != "Private-Use" {
+		t.Errorf("deleted custom block still found")
+	}
+
+	// IPv4-mapped blocks do not mix with IPv4 ones
+	if res := R.AddAddrBlock(AddrBlockInfo{Cidr: "::ffff:192.0.2.0/120", Name: "Mapped Test"}); res != 0 {
+		t.Errorf("failed to add mapped block")
+	}
+	for _, tc := range []struct {
+		ip   string
+		name string
+	}{
+		{"::ffff:192.0.2.5", "Mapped Test"},
+		{"192.0.2.5", "Documentation (TEST-NET-1)"},
+		{"::ffff:192.0.3.5", "IPv4-mapped Address"},
+		{"::ffff:0:0", "IPv4-mapped Address"},
+		{"::1", "Loopback Address"},
+	} {
+		if blk := R.FindAddrBlock(tc.ip); blk == nil || blk.Name != tc.name {
+			t.Errorf("classify %s got %v expected %s", tc.ip, blk, tc.name)
+		}
+	}
+	if res := R.DelAddrBlock("::ffff:192.0.2.0/120"); res != 0 || R.FindAddrBlock("::ffff:192.0.2.5").Name != "IPv4-mapped Address" {
+		t.Errorf("failed to delete mapped block")
+	}
+}
+
+func TestURPFCheck(t *testing.T) {
+	rt := TrieInit(false)
+	rt.AddTrie("0.0.0.0/0", URPFIntfList{"wan0"})
+	rt.AddTrie("10.0.0.0/8", URPFIntfList{"eth0"})
+	rt.AddTrie("10.1.0.0/16", URPFIntfList{"eth1", "eth2"})
+	rt.AddTrie("10.9.0.0/16", URPFIntfList{})
+
+	strict := URPFOpts{Mode: URPFStrict}
+	loose := URPFOpts{Mode: URPFLoose}
+	tests := []struct {
+		src    string
+		intf   string
+		opts   URPFOpts
+		result bool
+	}{
+		{"10.2.0.1", "eth0", strict, true},
+		{"10.2.0.1", "eth1", strict, false},
+		{"10.2.0.1", "eth1", loose, true},
+		{"10.1.0.1", "eth2", strict, true},
+		{"10.1.0.1", "eth1", strict, true},
+		{"10.1.0.1", "eth0", strict, false},
+		{"10.9.0.1", "eth0", loose, false},
+		{"8.8.8.8", "wan0", strict, false},
+		{"8.8.8.8", "wan0", loose, false},
+		{"8.8.8.8", "wan0", URPFOpts{Mode: URPFStrict, AllowDefault: true}, true},
+		{"8.8.8.8", "eth0", URPFOpts{Mode: URPFStrict, AllowDefault: true}, false},
+		{"8.8.8.8", "eth0", URPFOpts{Mode: URPFLoose, AllowDefault: true}, true},
+		{"bad-ip", "eth0", loose, false},
+	}
+	for _, tc := range tests {
+		if res := URPFCheck(rt, tc.src, tc.intf, tc.opts); res != tc.result {
+			t.Errorf("urpf check %s via %s (%v) got %v", tc.src, tc.intf, tc.opts, res)
+		}
+	}
+
+	rt6 := TrieInit(true)
+	rt6.AddTrie("2001:db8::/32", URPFIntfList{"eth0"})
+	if URPFCheck(rt6, "2001:db8::1", "eth0", strict) == false {
+		t.Errorf("v6 urpf check failed")
+	}
+	rt6.AddTrie("2001:db9::/32", 1)
+	if URPFCheck(rt6, "2001:db9::1", "eth0", loose) == true {
+		t.Errorf("urpf check passed for route without interfaces")
+	}
+}
+
+// counterCheck validates free list invariants of a Counter
+func counterCheck(t *testing.T, cR *Counter) {
+	t.Helper()
+	seen := make(map[int]bool)
+	last := -1
+	for rid := cR.start; rid != -1; rid = cR.counters[rid] {
+		if seen[rid] {
+			t.Fatalf("counter free list has a loop at %d", rid)
+		}
+		if cR.prev[rid] != last {
+			t.Fatalf("counter free list back link of %d is %d expected %d", rid, cR.prev[rid], last)
+		}
+		if cR.IsAllocated(rid + cR.begin) {
+			t.Fatalf("counter %d is in free list while allocated", rid+cR.begin)
+		}
+		seen[rid] = true
+		last = rid
+		if len(seen) > cR.len {
+			t.Fatalf("counter free list is longer than counter")
+		}
+	}
+	if len(seen) != cR.cap {
+		t.Fatalf("counter free list has %d entries, cap is %d", len(seen), cR.cap)
+	}
+	if last != -1 && last != cR.end {
+		t.Fatalf("counter free list ends at %d, end is %d", last, cR.end)
+	}
+	if CountAllSetBitsInArr(cR.allocated)+cR.cap != cR.len {
+		t.Fatalf("counter allocated %d and free %d do not add up to %d",
+			CountAllSetBitsInArr(cR.allocated), cR.cap, cR.len)
+	}
+}
+
+func TestCounterDoubleFree(t *testing.T) {
+	cR := NewCounter(100, 8)
+	ids := make(map[int]bool)
+	for i := 0; i < 8; i++ {
+		idx, _ := cR.GetCounter()
+		ids[idx] = true
+	}
+	counterCheck(t, cR)
+
+	if err := cR.PutCounter(103); err != nil {
+		t.Errorf("failed to put valid Counter 103")
+	}
+	if err := cR.PutCounter(103); err == nil {
+		t.Errorf("able to put Counter 103 twice")
+	}
+	if cR.IsAllocated(103) || !cR.IsAllocated(104) || cR.IsAllocated(99) {
+		t.Errorf("counter allocation state is wrong")
+	}
+	counterCheck(t, cR)
+
+	idx, err := cR.GetCounter()
+	if idx != 103 || err != nil {
+		t.Errorf("Counter get got %d of expected %d", idx, 103)
+	}
+	if _, err = cR.GetCounter(); err == nil {
+		t.Errorf("Counter handed out 103 twice")
+	}
+
+	cR = NewCounter(0, 4)
+	if err := cR.PutCounter(2); err == nil {
+		t.Errorf("able to put never allocated Counter 2")
+	}
+	counterCheck(t, cR)
+
+	r := rand.New(rand.NewSource(9))
+	cR = NewCounter(10, 64)
+	model := make(map[int]bool)
+	for i := 0; i < 5000; i++ {
+		if r.Intn(2) == 0 {
+			idx, err := cR.GetCounter()
+			if (err != nil) != (len(model) == 64) {
+				t.Fatalf("Counter get error mismatch %v with %d allocated", err, len(model))
+			}
+			if err == nil {
+				if model[idx] {
+					t.Fatalf("Counter %d handed out twice", idx)
+				}
+				model[idx] = true
+			}
+		} else {
+			id := 10 + r.Intn(64)
+			err := cR.PutCounter(id)
+			if (err == nil) != model[id] {
+				t.Fatalf("Counter put of %d got %v allocated %v", id, err, model[id])
+			}
+			delete(model, id)
+		}
+		counterCheck(t, cR)
+	}
+}
+
+func TestCounterReserve(t *testing.T) {
+	cR := NewCounter(1, 10)
+	for _, id := range []int{1, 5, 10} {
+		if err := cR.ReserveCounter(id); err != nil {
+			t.Errorf("failed to reserve Counter %d", id)
+		}
+		counterCheck(t, cR)
+	}
+	if err := cR.ReserveCounter(5); err == nil {
+		t.Errorf("reserved Counter 5 twice")
+	}
+	if err := cR.ReserveCounter(11); err == nil {
+		t.Errorf("reserved out of range Counter 11")
+	}
+
+	if err := cR.ReserveCounterList([]int{2, 5}); err == nil {
+		t.Errorf("reserved list with busy Counter 5")
+	}
+	if err := cR.ReserveCounterList([]int{2, 2}); err == nil {
+		t.Errorf("reserved list with duplicate Counter 2")
+	}
+	if cR.IsAllocated(2) {
+		t.Errorf("failed list reservation allocated Counter 2")
+	}
+	if err := cR.ReserveCounterList([]int{9, 2}); err != nil {
+		t.Errorf("failed to reserve list %s", err)
+	}
+	counterCheck(t, cR)
+
+	if err := cR.ReserveCounterRange(4, 3); err == nil {
+		t.Errorf("reserved range with busy Counter 5")
+	}
+	if err := cR.ReserveCounterRange(6, 3); err != nil {
+		t.Errorf("failed to reserve range %s", err)
+	}
+	counterCheck(t, cR)
+
+	// Only 3 and 4 remain in order
+	for _, exp := range []int{3, 4} {
+		if idx, err := cR.GetCounter(); idx != exp || err != nil {
+			t.Errorf("Counter get got %d of expected %d", idx, exp)
+		}
+	}
+	if _, err := cR.GetCounter(); err == nil {
+		t.Errorf("Counter get succeeded with all counters reserved")
+	}
+	counterCheck(t, cR)
+
+	cR.PutCounter(7)
+	cR.PutCounter(1)
+	counterCheck(t, cR)
+	if err := cR.ReserveCounter(1); err != nil {
+		t.Errorf("failed to reserve Counter 1 from tail")
+	}
+	counterCheck(t, cR)
+	if idx, err := cR.GetCounter(); idx != 7 || err != nil {
+		t.Errorf("Counter get got %d of expected %d", idx, 7)
+	}
+	counterCheck(t, cR)
+}
+
+type tCounterIntf interface {
+	GetCounter() (int, error)
+	PutCounter(id int) error
+}
+
+// counterStress runs concurrent allocators and checks that no counter
+// is ever owned by two of them at the same time
+func counterStress(t *testing.T, cI tCounterIntf, begin int, length int, get func(w int) (int, error)) {
+	owners := make([]int32, length)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			var held []int
+			for i := 0; i < 2000; i++ {
+				if len(held) < 16 && i%3 != 2 {
+					id, err := get(w)
+					if err != nil {
+						continue
+					}
+					if !atomic.CompareAndSwapInt32(&owners[id-begin], 0, int32(w+1)) {
+						t.Errorf("counter %d handed to two owners", id)
+						return
+					}
+					held = append(held, id)
+				} else if len(held) > 0 {
+					id := held[0]
+					held = held[1:]
+					atomic.StoreInt32(&owners[id-begin], 0)
+					if err := cI.PutCounter(id); err != nil {
+						t.Errorf("failed to put counter %d: %s", id, err)
+						return
+					}
+				}
+			}
+			for _, id := range held {
+				atomic.StoreInt32(&owners[id-begin], 0)
+				cI.PutCounter(id)
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+func TestSyncCounter(t *testing.T) {
+	sC := NewSyncCounter(1000, 100)
+	counterStress(t, sC, 1000, 100, func(w int) (int, error) { return sC.GetCounter() })
+	sC.Do(func(c *Counter) {
+		counterCheck(t, c)
+		if c.cap != 100 {
+			t.Errorf("sync counter leaked %d counters", 100-c.cap)
+		}
+	})
+	if err := sC.ReserveCounter(1050); err != nil || !sC.IsAllocated(1050) {
+		t.Errorf("failed to reserve sync counter 1050")
+	}
+}
+
+func TestShardedCounter(t *testing.T) {
+	shC := NewShardedCounter(1000, 100, 4)
+	counterStress(t, shC, 1000, 100, func(w int) (int, error) { return shC.GetCounterShard(w) })
+	counterStress(t, shC, 1000, 100, func(w int) (int, error) { return shC.GetCounter() })
+	for i := range shC.shards {
+		counterCheck(t, shC.shards[i].c)
+		if shC.shards[i].c.cap != shC.shards[i].c.len {
+			t.Errorf("sharded counter leaked counters in shard %d", i)
+		}
+	}
+
+	// A single caller drains all shards by stealing
+	shC = NewShardedCounter(0, 10, 4)
+	ids := make(map[int]bool)
+	for i := 0; i < 10; i++ {
+		id, err := shC.GetCounterShard(1)
+		if err != nil || ids[id] {
+			t.Fatalf("sharded counter get %d failed got %d:%v", i, id, err)
+		}
+		ids[id] = true
+	}
+	if _, err := shC.GetCounterShard(1); err == nil {
+		t.Errorf("sharded counter get succeeded when exhausted")
+	}
+	if err := shC.PutCounter(7); err != nil || shC.IsAllocated(7) {
+		t.Errorf("failed to put sharded counter 7")
+	}
+	if err := shC.PutCounter(7); err == nil {
+		t.Errorf("put sharded counter 7 twice")
+	}
+	if err := shC.PutCounter(10); err == nil {
+		t.Errorf("put out of range sharded counter 10")
+	}
+	if id, err := shC.GetCounterShard(0); id != 7 || err != nil {
+		t.Errorf("sharded counter get got %d expected 7", id)
+	}
+
+	// Any hint is fine including the most negative one
+	shC = NewShardedCounter(0, 10, 3)
+	minInt := -int(^uint(0)>>1) - 1
+	for _, hint := range []int{minInt, -1, -7, minInt + 1} {
+		if _, err := shC.GetCounterShard(hint); err != nil {
+			t.Errorf("sharded counter get with hint %d failed %v", hint, err)
+		}
+	}
+}
+
+func BenchmarkSyncCounterParallel(b *testing.B) {
+	sC := NewSyncCounter(0, 1<<16)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if id, err := sC.GetCounter(); err == nil {
+				sC.PutCounter(id)
+			}
+		}
+	})
+}
+
+func BenchmarkShardedCounterParallel(b *testing.B) {
+	shC := NewShardedCounter(0, 1<<16, 16)
+	var worker int32
+	b.RunParallel(func(pb *testing.PB) {
+		w := int(atomic.AddInt32(&worker, 1))
+		for pb.Next() {
+			if id, err := shC.GetCounterShard(w); err == nil {
+				shC.PutCounter(id)
+			}
+		}
+	})
+}
+
+func TestCounterRange(t *testing.T) {
+	cR := NewCounter(0, 32)
+	// Allocate everything and free runs of 5 at 2, 3 at 10 and 4 at 20
+	for i := 0; i < 32; i++ {
+		cR.GetCounter()
+	}
+	cR.PutCounterRange(2, 5)
+	cR.PutCounterRange(10, 3)
+	cR.PutCounterRange(20, 4)
+	counterCheck(t, cR)
+
+	for _, tc := range []struct{ n, start int }{{3, 10}, {3, 20}, {2, 2}, {3, 4}, {1, 23}} {
+		start, err := cR.GetCounterRange(tc.n)
+		if err != nil || start != tc.start {
+			t.Errorf("Counter range of %d got %d:%v expected %d", tc.n, start, err, tc.start)
+		}
+		counterCheck(t, cR)
+	}
+	if _, err := cR.GetCounterRange(2); err == nil {
+		t.Errorf("Counter range of 2 allocated from fragmented space")
+	}
+	if _, err := cR.GetCounterRange(33); err == nil {
+		t.Errorf("Counter range larger than counter allocated")
+	}
+	if err := cR.PutCounterRange(30, 4); err == nil {
+		t.Errorf("Counter range put beyond counter")
+	}
+	cR.PutCounter(29)
+	if err := cR.PutCounterRange(28, 3); err == nil || !cR.IsAllocated(28) {
+		t.Errorf("Counter range put with a free counter partially succeeded")
+	}
+
+	r := rand.New(rand.NewSource(11))
+	cR = NewCounter(50, 200)
+	for i := 0; i < 3000; i++ {
+		if r.Intn(2) == 0 {
+			n := 1 + r.Intn(8)
+			// Brute force best fit
+			bestStart, bestLen := -1, 0
+			for s := 0; s < 200; {
+				if cR.IsAllocated(50 + s) {
+					s++
+					continue
+				}
+				e := s
+				for e < 200 && !cR.IsAllocated(50+e) {
+					e++
+				}
+				if e-s >= n && (bestStart == -1 || e-s < bestLen) {
+					bestStart, bestLen = s, e-s
+				}
+				s = e
+			}
+			start, err := cR.GetCounterRange(n)
+			if bestStart == -1 {
+				if err == nil {
+					t.Fatalf("Counter range of %d succeeded without a fitting run", n)
+				}
+			} else if err != nil || start != bestStart+50 {
+				t.Fatalf("Counter range of %d got %d:%v expected %d", n, start, err, bestStart+50)
+			}
+		} else {
+			id := 50 + r.Intn(200)
+			if cR.IsAllocated(id) {
+				cR.PutCounter(id)
+			}
+		}
+		counterCheck(t, cR)
+	}
+}
+
+func TestCounterSnapshot(t *testing.T) {
+	r := rand.New(rand.NewSource(41))
+	cR := NewCounter(-20, 77)
+	for i := 0; i < 500; i++ {
+		if r.Intn(3) != 0 {
+			cR.GetCounter()
+		} else {
+			cR.PutCounter(-20 + r.Intn(77))
+		}
+	}
+
+	bin, err := cR.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Counter binary snapshot failed %v", err)
+	}
+	js, err := json.Marshal(cR)
+	if err != nil {
+		t.Fatalf("Counter json snapshot failed %v", err)
+	}
+
+	bC := new(Counter)
+	if err := bC.UnmarshalBinary(bin); err != nil {
+		t.Fatalf("Counter binary restore failed %v", err)
+	}
+	jC := new(Counter)
+	if err := json.Unmarshal(js, jC); err != nil {
+		t.Fatalf("Counter json restore failed %v", err)
+	}
+	sC, err := RestoreCounter(cR.Snapshot())
+	if err != nil {
+		t.Fatalf("Counter snapshot restore failed %v", err)
+	}
+
+	for _, c := range []*Counter{bC, jC, sC} {
+		counterCheck(t, c)
+		for id := -20; id < 57; id++ {
+			if c.IsAllocated(id) != cR.IsAllocated(id) {
+				t.Fatalf("Restored counter %d allocation mismatch", id)
+			}
+		}
+	}
+	// Restored counters hand out IDs in the same order
+	for {
+		id, err := cR.GetCounter()
+		for _, c := range []*Counter{bC, jC, sC} {
+			cid, cerr := c.GetCounter()
+			if cid != id || (cerr == nil) != (err == nil) {
+				t.Fatalf("Restored counter got %d:%v expected %d:%v", cid, cerr, id, err)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	// Corrupt snapshots are rejected
+	for i := 0; i < len(bin); i++ {
+		bad := append([]byte(nil), bin...)
+		bad[i] ^= 0x10
+		if err := new(Counter).UnmarshalBinary(bad); err == nil {
+			t.Fatalf("Counter binary restore accepted corruption at %d", i)
+		}
+	}
+	if err := new(Counter).UnmarshalBinary(bin[:len(bin)-1]); err == nil {
+		t.Fatalf("Counter binary restore accepted truncated snapshot")
+	}
+
+	// Version 2 snapshots without held counters are still readable
+	old := make([]byte, len(bin)-1)
+	copy(old, bin[:len(bin)-5])
+	old[4] = 2
+	binary.BigEndian.PutUint32(old[len(old)-4:], crc32.ChecksumIEEE(old[:len(old)-4]))
+	oC, nC := new(Counter), new(Counter)
+	if err := oC.UnmarshalBinary(old); err != nil || nC.UnmarshalBinary(bin) != nil {
+		t.Fatalf("Counter version 2 binary restore failed %v", err)
+	}
+	js1, _ := json.Marshal(nC)
+	if js2, _ := json.Marshal(oC); string(js1) != string(js2) {
+		t.Fatalf("Counter version 2 binary restore got %s expected %s", js2, js1)
+	}
+
+	bad := []*CounterSnapshot{
+		{Begin: 0, Length: 4, Allocated: []int{0, 1}, Free: []int{2}},
+		{Begin: 0, Length: 4, Allocated: []int{0, 1}, Free: []int{2, 2}},
+		{Begin: 0, Length: 4, Allocated: []int{0, 1}, Free: []int{1, 2, 3}},
+		{Begin: 0, Length: 4, Allocated: []int{0, 1, 1}, Free: []int{2, 3}},
+		{Begin: 0, Length: 4, Allocated: []int{0, 1}, Free: []int{2, 4}},
+		{Begin: 0, Length: 4, Allocated: []int{0, 1}, Free: []int{2}, Held: []CounterHeld{{ID: 2}}},
+		{Begin: 0, Length: 4, Allocated: []int{0, 1}, Free: []int{2}, Held: []CounterHeld{{ID: 1}}},
+		{Begin: 0, Length: 4, Allocated: []int{0, 1}, Free: []int{2}, Held: []CounterHeld{{ID: 3, Allocs: -1}}},
+		{Begin: 0, Length: 0},
+		{Begin: 0, Length: int(^uint(0) >> 1), Allocated: []int{0}},
+		{Begin: 0, Length: 1 << 40},
+	}
+	for i, snap := range bad {
+		if _, err := RestoreCounter(snap); err == nil {
+			t.Fatalf("Counter restore accepted bad snapshot %d", i)
+		}
+	}
+	if _, err := RestoreCounter(nil); err == nil {
+		t.Fatalf("Counter restore accepted nil snapshot")
+	}
+	for _, js := range []string{`{"begin":0,"length":2,"allocated":[0],"free":[0]}`,
+		`{"begin":0,"length":9223372036854775807,"allocated":[],"free":[]}`} {
+		if err := json.Unmarshal([]byte(js), new(Counter)); err == nil {
+			t.Fatalf("Counter json restore accepted bad snapshot %s", js)
+		}
+	}
+}
+
+func TestCounterPolicy(t *testing.T) {
+	cR := NewCounter(10, 16)
+	if cR.SetPolicy(CounterRandom+1) == nil {
+		t.Fatalf("Counter accepted unknown policy")
+	}
+
+	// LIFO hands back the most recently returned counter
+	cR.SetPolicy(CounterLIFO)
+	for i := 0; i < 8; i++ {
+		if id, _ := cR.GetCounter(); id != 10+i {
+			t.Fatalf("LIFO counter got %d expected %d", id, 10+i)
+		}
+	}
+	cR.PutCounter(13)
+	cR.PutCounter(11)
+	for _, exp := range []int{11, 13, 18} {
+		if id, _ := cR.GetCounter(); id != exp {
+			t.Fatalf("LIFO counter got %d expected %d", id, exp)
+		}
+	}
+	counterCheck(t, cR)
+
+	// Lowest first keeps allocations dense
+	cR.SetPolicy(CounterLowestFirst)
+	cR.PutCounter(17)
+	cR.PutCounter(12)
+	cR.PutCounter(15)
+	for _, exp := range []int{12, 15, 17, 19} {
+		if id, _ := cR.GetCounter(); id != exp {
+			t.Fatalf("Lowest first counter got %d expected %d", id, exp)
+		}
+	}
+	counterCheck(t, cR)
+
+	// Random is reproducible with a seeded source and exhausts the counter
+	seq := func() []int {
+		c := NewCounter(0, 100)
+		c.SetPolicy(CounterRandom)
+		c.SetRandSource(rand.NewSource(42))
+		var ids []int
+		for i := 1; ; i++ {
+			id, err := c.GetCounter()
+			if err != nil {
+				break
+			}
+			ids = append(ids, id)
+			if i%10 == 0 {
+				c.PutCounter(ids[len(ids)/2])
+				ids = append(ids[:len(ids)/2], ids[len(ids)/2+1:]...)
+			}
+			counterCheck(t, c)
+		}
+		return ids
+	}
+	s1, s2 := seq(), seq()
+	if len(s1) != 100 || fmt.Sprint(s1) != fmt.Sprint(s2) {
+		t.Fatalf("Random counter allocations are not reproducible")
+	}
+	inOrder := true
+	for i := range s1[:10] {
+		if s1[i] != i {
+			inOrder = false
+		}
+	}
+	if inOrder {
+		t.Fatalf("Random counter allocations are sequential")
+	}
+}
+
+func TestCounterQuarantine(t *testing.T) {
+	now := time.Unix(1000, 0)
+	cR := NewCounter(0, 4)
+	cR.SetQuarantine(10*time.Second, 0)
+	cR.SetClock(func() time.Time { return now })
+
+	for i := 0; i < 4; i++ {
+		cR.GetCounter()
+	}
+	cR.PutCounter(2)
+	if cR.IsAllocated(2) || cR.Quarantined() != 1 {
+		t.Fatalf("Quarantined counter state is wrong")
+	}
+	if cR.PutCounter(2) == nil {
+		t.Fatalf("Quarantined counter accepted a second put")
+	}
+	if cR.ReserveCounter(2) == nil {
+		t.Fatalf("Quarantined counter could be reserved")
+	}
+	if _, err := cR.GetCounter(); err == nil {
+		t.Fatalf("Quarantined counter was reused before its hold down")
+	}
+	counterCheck(t, cR)
+
+	now = now.Add(5 * time.Second)
+	cR.PutCounter(0)
+	now = now.Add(5 * time.Second)
+	if id, err := cR.GetCounter(); id != 2 || err != nil {
+		t.Fatalf("Counter got %d:%v after quarantine expected 2", id, err)
+	}
+	if _, err := cR.GetCounter(); err == nil {
+		t.Fatalf("Quarantined counter was reused before its hold down")
+	}
+
+	// Quarantined counters stay held across snapshot and restore
+	sC, err := RestoreCounter(cR.Snapshot())
+	if err != nil || sC.IsAllocated(0) || sC.Quarantined() != 1 {
+		t.Fatalf("Counter restore with quarantine failed %v", err)
+	}
+	counterCheck(t, sC)
+	bC := NewCounter(0, 1)
+	data, _ := cR.MarshalBinary()
+	if err := bC.UnmarshalBinary(data); err != nil || bC.Quarantined() != 1 {
+		t.Fatalf("Counter binary restore with quarantine failed %v", err)
+	}
+	for _, rC := range []*Counter{sC, bC} {
+		rC.SetClock(func() time.Time { return now })
+		if _, err := rC.GetCounter(); err == nil {
+			t.Fatalf("Restored quarantined counter was reused before its hold down")
+		}
+	}
+	now = now.Add(5 * time.Second)
+	for _, rC := range []*Counter{sC, bC} {
+		if id, err := rC.GetCounter(); id != 0 || err != nil || rC.Quarantined() != 0 {
+			t.Fatalf("Restored counter got %d:%v after quarantine expected 0", id, err)
+		}
+		counterCheck(t, rC)
+	}
+
+	// Turning quarantine off releases everything
+	cR.SetQuarantine(0, 0)
+	if id, err := cR.GetCounter(); id != 0 || err != nil {
+		t.Fatalf("Counter got %d:%v after quarantine off expected 0", id, err)
+	}
+	counterCheck(t, cR)
+
+	// Hold down by number of allocations
+	cR = NewCounter(0, 4)
+	cR.SetQuarantine(0, 3)
+	cR.GetCounter()
+	cR.PutCounter(0)
+	for _, exp := range []int{1, 2, 3, 0, -1} {
+		if id, _ := cR.GetCounter(); id != exp {
+			t.Fatalf("Counter got %d expected %d", id, exp)
+		}
+	}
+	counterCheck(t, cR)
+
+	// Counter with all free counters held by count does not get stuck
+	cR = NewCounter(0, 4)
+	cR.SetQuarantine(0, 3)
+	for i := 0; i < 4; i++ {
+		cR.GetCounter()
+	}
+	for i := 0; i < 4; i++ {
+		cR.PutCounter(i)
+	}
+	for _, exp := range []int{0, 1, 2, 3} {
+		if id, err := cR.GetCounter(); id != exp || err != nil {
+			t.Fatalf("Counter got %d:%v with all held expected %d", id, err, exp)
+		}
+	}
+	counterCheck(t, cR)
+
+	// Clock can be set before quarantine and delay is still honoured
+	now = time.Unix(2000, 0)
+	cR = NewCounter(0, 1)
+	cR.SetClock(func() time.Time { return now })
+	cR.SetQuarantine(time.Minute, 1)
+	cR.GetCounter()
+	cR.PutCounter(0)
+	if _, err := cR.GetCounter(); err == nil {
+		t.Fatalf("Quarantined counter was reused before its hold down")
+	}
+	now = now.Add(time.Minute)
+	if id, err := cR.GetCounter(); id != 0 || err != nil {
+		t.Fatalf("Counter got %d:%v after quarantine expected 0", id, err)
+	}
+}
+
+func TestCounterResize(t *testing.T) {
+	cR := NewCounter(100, 10)
+	for i := 0; i < 10; i++ {
+		cR.GetCounter()
+	}
+	if _, err := cR.GetCounter(); err == nil {
+		t.Fatalf("Counter did not overflow")
+	}
+
+	if _, err := cR.Resize(20); err != nil {
+		t.Fatalf("Counter grow failed %v", err)
+	}
+	counterCheck(t, cR)
+	for i := 110; i < 120; i++ {
+		if id, err := cR.GetCounter(); id != i || err != nil {
+			t.Fatalf("Grown counter got %d:%v expected %d", id, err, i)
+		}
+	}
+	counterCheck(t, cR)
+
+	for i := 105; i < 120; i++ {
+		if i != 107 && i != 113 {
+			cR.PutCounter(i)
+		}
+	}
+	busy, err := cR.Resize(6)
+	if err == nil || fmt.Sprint(busy) != "[107 113]" {
+		t.Fatalf("Counter shrink got %v:%v expected busy [107 113]", busy, err)
+	}
+	counterCheck(t, cR)
+
+	cR.PutCounter(107)
+	cR.PutCounter(113)
+	if _, err := cR.Resize(5); err != nil {
+		t.Fatalf("Counter shrink failed %v", err)
+	}
+	counterCheck(t, cR)
+	if _, err := cR.GetCounter(); err == nil || cR.PutCounter(105) == nil {
+		t.Fatalf("Shrunk counter still has counters beyond its end")
+	}
+
+	// Shrink and grow with quarantine and lowest first policy
+	cR.SetPolicy(CounterLowestFirst)
+	cR.SetQuarantine(time.Hour, 0)
+	cR.Resize(12)
+	for i := 105; i < 111; i++ {
+		if id, _ := cR.GetCounter(); id != i {
+			t.Fatalf("Counter got %d expected %d", id, i)
+		}
+	}
+	cR.PutCounter(110)
+	cR.PutCounter(102)
+	cR.PutCounter(109)
+	if _, err := cR.Resize(9); err != nil || cR.Quarantined() != 1 {
+		t.Fatalf("Counter shrink with quarantine failed %v", err)
+	}
+	counterCheck(t, cR)
+	cR.Resize(11)
+	for _, exp := range []int{109, 110, -1} {
+		if id, _ := cR.GetCounter(); id != exp {
+			t.Fatalf("Counter got %d expected %d", id, exp)
+		}
+	}
+	counterCheck(t, cR)
+}
+
+func TestSparseCounter(t *testing.T) {
+	sC := NewSparseCounter(10, 130)
+	for i := 0; i < 130; i++ {
+		if id, err := sC.GetCounter(); id != 10+i || err != nil {
+			t.Fatalf("Sparse counter got %d:%v expected %d", id, err, 10+i)
+		}
+	}
+	if _, err := sC.GetCounter(); err == nil {
+		t.Fatalf("Sparse counter did not overflow")
+	}
+	if sC.PutCounter(140) == nil || sC.PutCounter(75) != nil || sC.PutCounter(75) == nil {
+		t.Fatalf("Sparse counter put checks failed")
+	}
+	if id, _ := sC.GetCounter(); id != 75 {
+		t.Fatalf("Sparse counter got %d expected 75", id)
+	}
+
+	r := rand.New(rand.NewSource(45))
+	sC = NewSparseCounter(0, 1<<32)
+	ids := make(map[int]bool)
+	for i := 0; i < 20000; i++ {
+		switch r.Intn(4) {
+		case 0:
+			id := r.Intn(1 << 32)
+			if err := sC.ReserveCounter(id); (err == nil) == ids[id] {
+				t.Fatalf("Sparse counter reserve %d got %v", id, err)
+			}
+			ids[id] = true
+		case 1:
+			for id := range ids {
+				if sC.PutCounter(id) != nil {
+					t.Fatalf("Sparse counter put %d failed", id)
+				}
+				delete(ids, id)
+				break
+			}
+		default:
+			id, err := sC.GetCounter()
+			if err != nil || ids[id] {
+				t.Fatalf("Sparse counter got %d:%v which is in use", id, err)
+			}
+			for l := 0; l < id && l < 2000; l++ {
+				if !ids[l] {
+					t.Fatalf("Sparse counter got %d while %d is free", id, l)
+				}
+			}
+			ids[id] = true
+		}
+	}
+	if sC.InUse() != len(ids) {
+		t.Fatalf("Sparse counter in use %d expected %d", sC.InUse(), len(ids))
+	}
+	for id := range ids {
+		if !sC.IsAllocated(id) || sC.PutCounter(id) != nil {
+			t.Fatalf("Sparse counter %d lost", id)
+		}
+	}
+	if sC.root.child != nil || sC.root.full != 0 || sC.IsAllocated(0) {
+		t.Fatalf("Sparse counter did not release its nodes")
+	}
+}
+
+func TestSparseCounterFrom(t *testing.T) {
+	r := rand.New(rand.NewSource(49))
+	sC := NewSparseCounter(100, 5000)
+	ids := make(map[int]bool)
+	for i := 0; i < 5000; i++ {
+		from := 100 + r.Intn(5000)
+		id, err := sC.GetCounterFrom(from)
+		if err != nil || ids[id] {
+			t.Fatalf("Sparse counter from %d got %d:%v which is in use", from, id, err)
+		}
+		// Nothing free between from and id, wrapping around
+		for l := from; l != id; {
+			if !ids[l] {
+				t.Fatalf("Sparse counter from %d got %d while %d is free", from, id, l)
+			}
+			if l++; l == 5100 {
+				l = 100
+			}
+		}
+		ids[id] = true
+		if i%3 == 0 {
+			p := 100 + r.Intn(5000)
+			if ids[p] {
+				sC.PutCounter(p)
+				delete(ids, p)
+			}
+		}
+		if len(ids) == 5000 {
+			break
+		}
+	}
+	if _, err := sC.GetCounterFrom(99); err == nil {
+		t.Fatalf("Sparse counter accepted out of range start")
+	}
+}
+
+func TestOwnedCounter(t *testing.T) {
+	oC := NewOwnedCounter(NewCounter(1, 20))
+	for i := 0; i < 12; i++ {
+		oC.GetCounter(fmt.Sprintf("svc%d", i%3))
+	}
+	if err := oC.ReserveCounter(20, "svc1"); err != nil {
+		t.Fatalf("Owned counter reserve failed %v", err)
+	}
+	if owner, err := oC.Owner(5); owner != "svc1" || err != nil {
+		t.Fatalf("Owned counter 5 owner %v:%v expected svc1", owner, err)
+	}
+	if _, err := oC.Owner(15); err == nil {
+		t.Fatalf("Free counter has an owner")
+	}
+	if ids := fmt.Sprint(oC.OwnerCounters("svc1")); ids != "[2 5 8 11 20]" {
+		t.Fatalf("Owned counter svc1 has %s", ids)
+	}
+
+	if n := oC.PutOwnerCounters("svc1"); n != 5 {
+		t.Fatalf("Owned counter released %d for svc1 expected 5", n)
+	}
+	if oC.c.IsAllocated(5) || len(oC.OwnerCounters("svc1")) != 0 {
+		t.Fatalf("Owned counter svc1 still holds counters")
+	}
+	if owners := fmt.Sprint(oC.Owners()); owners != "[svc0 svc2]" {
+		t.Fatalf("Owned counter owners are %s", owners)
+	}
+
+	oC.PutCounter(4)
+	var walk []string
+	oC.Walk(func(id int, owner interface{}) bool {
+		walk = append(walk, fmt.Sprintf("%d:%v", id, owner))
+		return id < 9
+	})
+	if fmt.Sprint(walk) != "[1:svc0 3:svc2 6:svc2 7:svc0 9:svc2]" {
+		t.Fatalf("Owned counter walk got %v", walk)
+	}
+	counterCheck(t, oC.c)
+
+	// Any comparable value can be an owner
+	type svcKey struct {
+		name string
+		port int
+	}
+	oC = NewOwnedCounter(NewCounter(1, 4))
+	oC.GetCounter(svcKey{"web", 80})
+	oC.GetCounter(svcKey{"web", 443})
+	oC.GetCounter(svcKey{"web", 80})
+	if owner, _ := oC.Owner(2); owner != (svcKey{"web", 443}) {
+		t.Fatalf("Owned counter 2 owner %v expected web:443", owner)
+	}
+	if ids := fmt.Sprint(oC.OwnerCounters(svcKey{"web", 80})); ids != "[1 3]" {
+		t.Fatalf("Owned counter web:80 has %s", ids)
+	}
+	if owners := fmt.Sprint(oC.Owners()); owners != "[{web 80} {web 443}]" {
+		t.Fatalf("Owned counter owners are %s", owners)
+	}
+}
+
+func TestCounterHandle(t *testing.T) {
+	cR := NewCounter(0, 2)
+	h1, err := cR.GetCounterHandle()
+	if err != nil || !cR.ValidHandle(h1) {
+		t.Fatalf("Counter handle %v:%v is not valid", h1, err)
+	}
+	if cR.PutCounterHandle(h1) != nil || cR.ValidHandle(h1) {
+		t.Fatalf("Counter handle %v put failed", h1)
+	}
+	cR.GetCounter()
+	h2, _ := cR.GetCounterHandle()
+	if h2.ID != h1.ID || h2.Gen == h1.Gen {
+		t.Fatalf("Reused counter handle %v has same generation as %v", h2, h1)
+	}
+	if cR.ValidHandle(h1) || cR.PutCounterHandle(h1) == nil {
+		t.Fatalf("Stale counter handle %v is accepted", h1)
+	}
+	if !cR.IsAllocated(h2.ID) || cR.PutCounterHandle(h2) != nil {
+		t.Fatalf("Counter handle %v put failed", h2)
+	}
+
+	if _, err := cR.CounterHandleOf(h2.ID); err == nil {
+		t.Fatalf("Free counter has a handle")
+	}
+	cR.ReserveCounter(h2.ID)
+	h3, err := cR.CounterHandleOf(h2.ID)
+	if err != nil || h3.Gen == h2.Gen || !cR.ValidHandle(h3) {
+		t.Fatalf("Reserved counter handle %v:%v is wrong", h3, err)
+	}
+
+	cR.Resize(4)
+	h4, _ := cR.GetCounterHandle()
+	if h4.ID != 2 || !cR.ValidHandle(h4) {
+		t.Fatalf("Grown counter handle %v is not valid", h4)
+	}
+	counterCheck(t, cR)
+
+	// Generations survive a restore, stale handles stay stale and live
+	// ones stay valid
+	for _, codec := range []string{"binary", "json"} {
+		cR = NewCounter(0, 2)
+		old, _ := cR.GetCounterHandle()
+		live, _ := cR.GetCounterHandle()
+		cR.PutCounter(old.ID)
+		var err error
+		if codec == "binary" {
+			var data []byte
+			data, _ = cR.MarshalBinary()
+			cR = new(Counter)
+			err = cR.UnmarshalBinary(data)
+		} else {
+			var data []byte
+			data, _ = json.Marshal(cR)
+			cR = new(Counter)
+			err = json.Unmarshal(data, cR)
+		}
+		if err != nil || !cR.ValidHandle(live) {
+			t.Fatalf("Counter %s restore lost live handle %v:%v", codec, live, err)
+		}
+		h, _ := cR.GetCounterHandle()
+		if h.ID != old.ID || h.Gen == old.Gen || cR.ValidHandle(old) || cR.PutCounterHandle(old) == nil {
+			t.Fatalf("Counter %s restore revived stale handle %v as %v", codec, old, h)
+		}
+	}
+
+	// Generations survive a shrink followed by a grow
+	cR = NewCounter(0, 2)
+	cR.GetCounter()
+	old, _ := cR.GetCounterHandle()
+	cR.PutCounter(old.ID)
+	cR.Resize(1)
+	cR.Resize(2)
+	if h, _ := cR.GetCounterHandle(); h.ID != old.ID || h.Gen == old.Gen || cR.ValidHandle(old) {
+		t.Fatalf("Regrown counter revived stale handle %v as %v", old, h)
+	}
+	if _, err := RestoreCounter(&CounterSnapshot{Length: 2, Free: []int{0, 1}, Gen: []uint32{1}}); err == nil {
+		t.Fatalf("Counter restore accepted short generations")
+	}
+}
+
+func TestCounterMetrics(t *testing.T) {
+	var events []string
+	cR := NewCounter(0, 10)
+	if cR.AddThreshold(0, func(int, int, bool) {}) == nil {
+		t.Fatalf("Counter accepted bad threshold")
+	}
+	for _, pct := range []int{50, 90} {
+		pct := pct
+		cR.AddThreshold(pct, func(inUse int, capacity int, rising bool) {
+			events = append(events, fmt.Sprintf("%d:%d/%d:%v", pct, inUse, capacity, rising))
+		})
+	}
+
+	for i := 0; i < 11; i++ {
+		cR.GetCounter()
+	}
+	if cR.InUse() != 10 || cR.Free() != 0 || cR.Capacity() != 10 || cR.Failures() != 1 {
+		t.Fatalf("Counter usage %d/%d/%d failures %d is wrong",
+			cR.InUse(), cR.Free(), cR.Capacity(), cR.Failures())
+	}
+	if _, err := cR.GetCounterRange(2); err == nil || cR.Failures() != 2 {
+		t.Fatalf("Counter range failure is not counted")
+	}
+
+	cR.SetQuarantine(time.Hour, 0)
+	for i := 0; i < 6; i++ {
+		cR.PutCounter(i)
+	}
+	if cR.InUse() != 4 || cR.Free() != 0 || cR.Quarantined() != 6 || cR.HighWatermark() != 10 {
+		t.Fatalf("Counter usage %d/%d/%d watermark %d is wrong",
+			cR.InUse(), cR.Free(), cR.Quarantined(), cR.HighWatermark())
+	}
+	cR.SetQuarantine(0, 0)
+	cR.Resize(20)
+	cR.ResetStats()
+	if cR.HighWatermark() != 4 || cR.Failures() != 0 || cR.Free() != 16 {
+		t.Fatalf("Counter stats reset failed")
+	}
+	cR.GetCounterRange(6)
+
+	exp := "[50:5/10:true 90:9/10:true 90:8/10:false 50:4/10:false 50:10/20:true]"
+	if fmt.Sprint(events) != exp {
+		t.Fatalf("Counter threshold events %v expected %s", events, exp)
+	}
+
+	data, _ := cR.MarshalBinary()
+	cR.UnmarshalBinary(data)
+	if cR.InUse() != 10 || cR.HighWatermark() != 10 || len(events) != 5 {
+		t.Fatalf("Restored counter usage is wrong")
+	}
+	counterCheck(t, cR)
+}
+
+func TestNatPool(t *testing.T) {
+	nP := NewNatPool(NatEIM, CounterRandom)
+	if nP.AddNatIP("10.0.0.1", 1000, 1099) != nil || nP.AddNatIP("10.0.0.2", 2000, 2099) != nil {
+		t.Fatalf("NAT pool address add failed")
+	}
+	if nP.AddNatIP("10.0.0.1", 1000, 1099) == nil || nP.AddNatIP("10.0.0.x", 1, 2) == nil ||
+		nP.AddNatIP("10.0.0.3", 2000, 1000) == nil || nP.AddNatIP("10.0.0.4", 0, 10) == nil {
+		t.Fatalf("NAT pool accepted a bad address")
+	}
+
+	used := make(map[string]bool)
+	count := make(map[string]int)
+	for i := 0; i < 200; i++ {
+		ip, port, err := nP.GetNatPort("")
+		key := fmt.Sprintf("%s:%d", ip, port)
+		if err != nil || used[key] {
+			t.Fatalf("NAT pool got %s:%v which is in use", key, err)
+		}
+		if (ip == "10.0.0.1" && (port < 1000 || port > 1099)) ||
+			(ip == "10.0.0.2" && (port < 2000 || port > 2099)) {
+			t.Fatalf("NAT pool got %s out of its port range", key)
+		}
+		used[key] = true
+		count[ip]++
+		if d := count["10.0.0.1"] - count["10.0.0.2"]; d > 1 || d < -1 {
+			t.Fatalf("NAT pool mappings are uneven %v", count)
+		}
+	}
+	if _, _, err := nP.GetNatPort(""); err == nil {
+		t.Fatalf("NAT pool did not overflow")
+	}
+
+	// Draining address gets no new mappings and goes away once idle
+	nP.DelNatIP("10.0.0.1")
+	nP.PutNatPort("10.0.0.2", 2050, "")
+	nP.PutNatPort("10.0.0.1", 1050, "")
+	if ip, port, _ := nP.GetNatPort(""); ip != "10.0.0.2" || port != 2050 {
+		t.Fatalf("NAT pool got %s:%d expected 10.0.0.2:2050", ip, port)
+	}
+	if info := nP.NatIPs(); len(info) != 2 || !info[0].Draining || info[0].InUse != 99 {
+		t.Fatalf("NAT pool draining address info %v is wrong", info)
+	}
+	for port := 1000; port < 1100; port++ {
+		nP.PutNatPort("10.0.0.1", port, "")
+	}
+	if info := nP.NatIPs(); len(info) != 1 || info[0].IP != "10.0.0.2" {
+		t.Fatalf("NAT pool drained address is not removed %v", info)
+	}
+	if nP.PutNatPort("10.0.0.1", 1000, "") == nil || nP.DelNatIP("10.0.0.1") == nil {
+		t.Fatalf("NAT pool removed address is still usable")
+	}
+
+	// Address dependent mapping reuses ports for other destinations
+	nP = NewNatPool(NatADM, CounterFIFO)
+	nP.AddNatIP("2001:db8::1", 5000, 5001)
+	nP.AddNatIP("2001:db8:0::2", 6000, 6001)
+	for _, dst := range []string{"8.8.8.8", "1.1.1.1"} {
+		for _, exp := range []string{"2001:db8::1:5000", "2001:db8::2:6000",
+			"2001:db8::1:5001", "2001:db8::2:6001"} {
+			ip, port, err := nP.GetNatPort(dst)
+			if fmt.Sprintf("%s:%d", ip, port) != exp || err != nil {
+				t.Fatalf("NAT pool got %s:%d:%v for %s expected %s", ip, port, err, dst, exp)
+			}
+		}
+		if _, _, err := nP.GetNatPort(dst); err == nil {
+			t.Fatalf("NAT pool did not overflow for %s", dst)
+		}
+	}
+	if nP.PutNatPort("2001:db8::1", 5000, "9.9.9.9") == nil ||
+		nP.PutNatPort("2001:db8::1", 5000, "8.8.8.8") != nil {
+		t.Fatalf("NAT pool address dependent put failed")
+	}
+	if info := nP.NatIPs(); info[0].InUse != 3 || info[1].InUse != 4 {
+		t.Fatalf("NAT pool address dependent usage %v is wrong", info)
+	}
+
+	// New destinations spread over addresses too
+	nP = NewNatPool(NatADM, CounterRandom)
+	for i := 1; i <= 3; i++ {
+		nP.AddNatIP(fmt.Sprintf("10.0.0.%d", i), 1024, 65535)
+	}
+	for i := 0; i < 30; i++ {
+		if _, port, err := nP.GetNatPort(fmt.Sprintf("8.8.%d.%d", i/256, i%256)); err != nil ||
+			port < 1024 || port > 65535 {
+			t.Fatalf("NAT pool got port %d:%v out of range", port, err)
+		}
+	}
+	// Destinations share ports of an address but never within one
+	ports := make(map[int]bool)
+	for i := 0; i < 300; i++ {
+		ip, port, err := nP.GetNatPort("1.1.1.1")
+		if err != nil || ports[port*4+int(net.ParseIP(ip).To4()[3])] {
+			t.Fatalf("NAT pool got %s:%d:%v which is in use", ip, port, err)
+		}
+		ports[port*4+int(net.ParseIP(ip).To4()[3])] = true
+	}
+	for key := range ports {
+		if nP.PutNatPort(fmt.Sprintf("10.0.0.%d", key%4), key/4, "1.1.1.1") != nil {
+			t.Fatalf("NAT pool put %d failed", key)
+		}
+	}
+	for _, info := range nP.NatIPs() {
+		if info.InUse != 10 {
+			t.Fatalf("NAT pool address dependent mappings are uneven %v", nP.NatIPs())
+		}
+	}
+
+	// Policy picks new ports the same way in both modes
+	for _, tc := range []struct {
+		mode   int
+		policy int
+		exp    int
+	}{
+		{NatEIM, CounterFIFO, 102}, {NatADM, CounterFIFO, 102},
+		{NatEIM, CounterLowestFirst, 100}, {NatADM, CounterLowestFirst, 100},
+	} {
+		nP = NewNatPool(tc.mode, tc.policy)
+		nP.AddNatIP("10.0.0.1", 100, 103)
+		nP.GetNatPort("8.8.8.8")
+		nP.GetNatPort("8.8.8.8")
+		nP.PutNatPort("10.0.0.1", 100, "8.8.8.8")
+		if _, port, _ := nP.GetNatPort("8.8.8.8"); port != tc.exp {
+			t.Fatalf("NAT pool mode %d policy %d got %d expected %d", tc.mode, tc.policy, port, tc.exp)
+		}
+	}
+
+	// Same random source gives the same ports
+	var seq [2][]int
+	for i := range seq {
+		nP = NewNatPool(NatADM, CounterRandom)
+		nP.AddNatIP("10.0.0.1", 1024, 65535)
+		nP.SetRandSource(rand.NewSource(49))
+		for j := 0; j < 20; j++ {
+			_, port, _ := nP.GetNatPort(fmt.Sprintf("8.8.8.%d", j%3))
+			seq[i] = append(seq[i], port)
+		}
+	}
+	if fmt.Sprint(seq[0]) != fmt.Sprint(seq[1]) {
+		t.Fatalf("NAT pool ports %v and %v differ with the same source", seq[0], seq[1])
+	}
+}
+
+func TestQuotaCounter(t *testing.T) {
+	qC := NewQuotaCounter(NewCounter(1, 10))
+	tA, _ := qC.Root().AddQuota("tenantA", 6)
+	tB, _ := qC.Root().AddQuota("tenantB", QuotaUnlimited)
+	svc1, _ := tA.AddQuota("svc1", 4)
+	svc2, _ := tA.AddQuota("svc2", 4)
+	if _, err := tA.AddQuota("svc1", 1); err == nil {
+		t.Fatalf("Quota node added twice")
+	}
+
+	for i := 0; i < 4; i++ {
+		if _, err := qC.GetCounter(svc1); err != nil {
+			t.Fatalf("Quota counter get failed %v", err)
+		}
+	}
+	if _, err := qC.GetCounter(svc1); err != ErrQuota {
+		t.Fatalf("Quota counter svc1 got %v expected quota error", err)
+	}
+	qC.GetCounter(svc2)
+	if err := qC.ReserveCounter(svc2, 10); err != nil {
+		t.Fatalf("Quota counter reserve failed %v", err)
+	}
+	if _, err := qC.GetCounter(svc2); err != ErrQuota {
+		t.Fatalf("Quota counter svc2 got %v expected tenant quota error", err)
+	}
+	if tA.Used() != 6 || svc2.Used() != 2 || qC.Root().Used() != 6 {
+		t.Fatalf("Quota usage %d/%d/%d is wrong", tA.Used(), svc2.Used(), qC.Root().Used())
+	}
+
+	for i := 0; i < 4; i++ {
+		qC.GetCounter(tB)
+	}
+	if _, err := qC.GetCounter(tB); err == nil || err == ErrQuota {
+		t.Fatalf("Quota counter got %v expected overflow", err)
+	}
+
+	if qC.QuotaOf(10) != svc2 || qC.PutCounter(10) != nil || qC.PutCounter(10) == nil {
+		t.Fatalf("Quota counter put failed")
+	}
+	if tA.Used() != 5 || svc2.Used() != 1 || qC.Root().Used() != 9 {
+		t.Fatalf("Quota usage %d/%d/%d is wrong after put", tA.Used(), svc2.Used(), qC.Root().Used())
+	}
+	if id, err := qC.GetCounter(svc2); id != 10 || err != nil {
+		t.Fatalf("Quota counter got %d:%v expected 10", id, err)
+	}
+
+	if tA.DelQuota("svc2") == nil {
+		t.Fatalf("Quota node in use was deleted")
+	}
+	svc3, _ := tA.AddQuota("svc3", 1)
+	tA.DelQuota("svc3")
+	if _, err := qC.GetCounter(svc3); err == nil || err == ErrQuota {
+		t.Fatalf("Deleted quota node got %v", err)
+	}
+	tA.SetLimit(QuotaUnlimited)
+	if _, err := qC.GetCounter(svc2); err == nil || err == ErrQuota {
+		t.Fatalf("Quota counter got %v expected overflow", err)
+	}
+	counterCheck(t, qC.c)
+}
@@ -0,0 +1,279 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright Copyright (c) 2022 NetLOX Inc
+
+package loxilib
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+)
+
+// NAT port mapping modes
+const (
+	// NatEIM - Endpoint independent mapping, a port is used by one mapping
+	// whatever the destination
+	NatEIM = iota
+	// NatADM - Address dependent mapping, a port is reused for mappings
+	// towards different destinations
+	NatADM
+)
+
+// natIP - an address of the pool with its port counters
+type natIP struct {
+	ip       string
+	pBegin   int
+	pLen     int
+	inUse    int
+	draining bool
+	c        *Counter
+	ports    []int
+	users    map[int]int
+	dst      map[string]map[int]struct{}
+}
+
+// NatPool - Allocator of (IP, port) pairs for source NAT
+// Every address has its own port range. A new mapping goes to the address
+// with the most free ports so that mappings spread evenly over addresses.
+// In address dependent mode, ports taken from an address are shared by
+// destinations and only the ports in use towards each destination are
+// kept so that memory follows the mappings in use
+type NatPool struct {
+	mode   int
+	policy int
+	src    rand.Source
+	ips    []*natIP
+}
+
+// NatIPInfo - Usage information of an address in a NatPool
+type NatIPInfo struct {
+	IP        string
+	PortBegin int
+	PortEnd   int
+	InUse     int
+	Draining  bool
+}
+
+// NewNatPool - Create a NAT pool
+// mode is NatEIM or NatADM and policy is the Counter allocation policy used
+// for ports, CounterRandom makes ports hard to predict. In address dependent
+// mode, a destination first reuses ports taken for other destinations in the
+// order they were taken, new ports are taken as per the policy
+func NewNatPool(mode int, policy int) *NatPool {
+	P := new(NatPool)
+	P.mode = mode
+	P.policy = policy
+	return P
+}
+
+// SetRandSource - Set the source of randomness for CounterRandom policy
+// It is used by the port counters of all addresses of the pool
+func (P *NatPool) SetRandSource(src rand.Source) {
+	P.src = src
+	for _, n := range P.ips {
+		n.c.SetRandSource(src)
+	}
+}
+
+func natIPKey(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func (P *NatPool) find(ip string) (int, *natIP) {
+	key := natIPKey(ip)
+	for i, n := range P.ips {
+		if n.ip == key {
+			return i, n
+		}
+	}
+	return -1, nil
+}
+
+func (P *NatPool) newCounter(n *natIP) *Counter {
+	c := NewCounter(n.pBegin, n.pLen)
+	c.SetPolicy(P.policy)
+	if P.src != nil {
+		c.SetRandSource(P.src)
+	}
+	return c
+}
+
+// free returns the number of free ports of n towards dst
+func (P *NatPool) free(n *natIP, dst string) int {
+	if P.mode == NatEIM {
+		return n.c.Free()
+	}
+	return n.c.Free() + len(n.ports) - len(n.dst[dst])
+}
+
+// getSharedPort gets a port of n for dst, reusing a port taken for
+// other destinations if possible
+func (P *NatPool) getSharedPort(n *natIP, dst string) (int, error) {
+	used := n.dst[dst]
+	if used == nil {
+		used = make(map[int]struct{})
+		n.dst[dst] = used
+	}
+	for _, port := range n.ports {
+		if _, ok := used[port]; !ok {
+			used[port] = struct{}{}
+			n.users[port]++
+			return port, nil
+		}
+	}
+
+	port, err := n.c.GetCounter()
+	if err != nil {
+		if len(used) == 0 {
+			delete(n.dst, dst)
+		}
+		return -1, err
+	}
+	n.ports = append(n.ports, port)
+	used[port] = struct{}{}
+	n.users[port] = 1
+	return port, nil
+}
+
+// putSharedPort returns a port of n used towards dst, the port goes back
+// to the counter once no destination uses it
+func (P *NatPool) putSharedPort(n *natIP, port int, dst string) error {
+	used := n.dst[dst]
+	if _, ok := used[port]; !ok {
+		return errors.New("NotAllocated")
+	}
+	delete(used, port)
+	if len(used) == 0 {
+		delete(n.dst, dst)
+	}
+	if n.users[port]--; n.users[port] > 0 {
+		return nil
+	}
+	delete(n.users, port)
+	for i, p := range n.ports {
+		if p == port {
+			n.ports = append(n.ports[:i], n.ports[i+1:]...)
+			break
+		}
+	}
+	return n.c.PutCounter(port)
+}
+
+// AddNatIP - Add an address with ports portBegin to portEnd to the pool
+// Adding back an address being drained makes it active again
+// returns nil on success or error
+func (P *NatPool) AddNatIP(ip string, portBegin int, portEnd int) error {
+	key := natIPKey(ip)
+	if key == "" || portBegin < 1 || portEnd > 65535 || portBegin > portEnd {
+		return errors.New("Range")
+	}
+	if _, n := P.find(key); n != nil {
+		if n.draining == true && n.pBegin == portBegin && n.pLen == portEnd-portBegin+1 {
+			n.draining = false
+			return nil
+		}
+		return errors.New("Exists")
+	}
+
+	n := &natIP{ip: key, pBegin: portBegin, pLen: portEnd - portBegin + 1}
+	n.c = P.newCounter(n)
+	if P.mode == NatADM {
+		n.users = make(map[int]int)
+		n.dst = make(map[string]map[int]struct{})
+	}
+	P.ips = append(P.ips, n)
+	return nil
+}
+
+// DelNatIP - Remove an address from the pool
+// An address with mappings in use is drained, it gets no new mappings and
+// goes away once all of its ports are returned
+// returns nil on success or error
+func (P *NatPool) DelNatIP(ip string) error {
+	i, n := P.find(ip)
+	if n == nil {
+		return errors.New("NotFound")
+	}
+	if n.inUse > 0 {
+		n.draining = true
+		return nil
+	}
+	P.ips = append(P.ips[:i], P.ips[i+1:]...)
+	return nil
+}
+
+// GetNatPort - Get an address and port for a mapping towards dst
+// dst is not used for endpoint independent mapping
+// returns address, port or error
+func (P *NatPool) GetNatPort(dst string) (string, int, error) {
+	var best *natIP
+	var bestFree int
+
+	if P.mode == NatEIM {
+		dst = ""
+	}
+	for _, n := range P.ips {
+		if n.draining == true {
+			continue
+		}
+		// Ties go to the address with fewer mappings overall, else a
+		// new destination always lands on the first address
+		free := P.free(n, dst)
+		if free > bestFree || (free == bestFree && free > 0 && n.inUse < best.inUse) {
+			best, bestFree = n, free
+		}
+	}
+	if best == nil {
+		return "", -1, errors.New("Overflow")
+	}
+
+	var port int
+	var err error
+	if P.mode == NatADM {
+		port, err = P.getSharedPort(best, dst)
+	} else {
+		port, err = best.c.GetCounter()
+	}
+	if err != nil {
+		return "", -1, err
+	}
+	best.inUse++
+	return best.ip, port, nil
+}
+
+// PutNatPort - Return a mapping's address and port to the pool
+// dst is the one used with GetNatPort and is not used for endpoint
+// independent mapping
+// returns nil on success or error
+func (P *NatPool) PutNatPort(ip string, port int, dst string) error {
+	i, n := P.find(ip)
+	if n == nil {
+		return errors.New("NotFound")
+	}
+
+	if P.mode == NatADM {
+		if err := P.putSharedPort(n, port, dst); err != nil {
+			return err
+		}
+	} else if err := n.c.PutCounter(port); err != nil {
+		return err
+	}
+	n.inUse--
+	if n.draining == true && n.inUse == 0 {
+		P.ips = append(P.ips[:i], P.ips[i+1:]...)
+	}
+	return nil
+}
+
+// NatIPs - Get usage information of all the addresses of the pool
+func (P *NatPool) NatIPs() []NatIPInfo {
+	info := make([]NatIPInfo, 0, len(P.ips))
+	for _, n := range P.ips {
+		info = append(info, NatIPInfo{n.ip, n.pBegin, n.pBegin + n.pLen - 1, n.inUse, n.draining})
+	}
+	return info
+}
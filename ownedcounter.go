@@ -0,0 +1,143 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright Copyright (c) 2022 NetLOX Inc
+
+package loxilib
+
+import (
+	"errors"
+	"sort"
+)
+
+// OwnedCounter - Counter which records the owner of allocated counters
+// Owner is any comparable key chosen by the caller, like a service name or
+// a struct identifying a service, so that all counters held by it can be
+// found and released together
+type OwnedCounter struct {
+	c     *Counter
+	owner map[int]interface{}
+	owned map[interface{}]map[int]struct{}
+}
+
+// NewOwnedCounter - Add owner tracking to counter c
+// c should be used only through the OwnedCounter afterwards
+func NewOwnedCounter(c *Counter) *OwnedCounter {
+	O := new(OwnedCounter)
+	O.c = c
+	O.owner = make(map[int]interface{})
+	O.owned = make(map[interface{}]map[int]struct{})
+	return O
+}
+
+func (O *OwnedCounter) tag(id int, owner interface{}) {
+	O.owner[id] = owner
+	ids := O.owned[owner]
+	if ids == nil {
+		ids = make(map[int]struct{})
+		O.owned[owner] = ids
+	}
+	ids[id] = struct{}{}
+}
+
+func (O *OwnedCounter) untag(id int) {
+	owner := O.owner[id]
+	delete(O.owner, id)
+	delete(O.owned[owner], id)
+	if len(O.owned[owner]) == 0 {
+		delete(O.owned, owner)
+	}
+}
+
+// GetCounter - Get next available counter for owner
+func (O *OwnedCounter) GetCounter(owner interface{}) (int, error) {
+	id, err := O.c.GetCounter()
+	if err != nil {
+		return id, err
+	}
+	O.tag(id, owner)
+	return id, nil
+}
+
+// ReserveCounter - Allocate a specific counter for owner
+// returns nil on success or error
+func (O *OwnedCounter) ReserveCounter(id int, owner interface{}) error {
+	if err := O.c.ReserveCounter(id); err != nil {
+		return err
+	}
+	O.tag(id, owner)
+	return nil
+}
+
+// PutCounter - Return a counter to the available list
+func (O *OwnedCounter) PutCounter(id int) error {
+	if err := O.c.PutCounter(id); err != nil {
+		return err
+	}
+	O.untag(id)
+	return nil
+}
+
+// Owner - Get the owner of an allocated counter
+// returns owner or error if the counter is not allocated
+func (O *OwnedCounter) Owner(id int) (interface{}, error) {
+	owner, ok := O.owner[id]
+	if !ok {
+		return nil, errors.New("NotAllocated")
+	}
+	return owner, nil
+}
+
+// OwnerCounters - Get the counters held by owner in ascending order
+func (O *OwnedCounter) OwnerCounters(owner interface{}) []int {
+	ids := make([]int, 0, len(O.owned[owner]))
+	for id := range O.owned[owner] {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// PutOwnerCounters - Return all the counters held by owner
+// returns the number of counters returned
+func (O *OwnedCounter) PutOwnerCounters(owner interface{}) int {
+	ids := O.OwnerCounters(owner)
+	for _, id := range ids {
+		O.PutCounter(id)
+	}
+	return len(ids)
+}
+
+// Owners - Get all the owners holding counters ordered by the lowest
+// counter each of them holds
+func (O *OwnedCounter) Owners() []interface{} {
+	owners := make([]interface{}, 0, len(O.owned))
+	lowest := make(map[interface{}]int, len(O.owned))
+	for owner, ids := range O.owned {
+		owners = append(owners, owner)
+		for id := range ids {
+			if l, ok := lowest[owner]; !ok || id < l {
+				lowest[owner] = id
+			}
+		}
+	}
+	sort.Slice(owners, func(i, j int) bool {
+		return lowest[owners[i]] < lowest[owners[j]]
+	})
+	return owners
+}
+
+// Walk - Call fn for every allocated counter and its owner in ascending
+// order of counters, walk stops when fn returns false. fn may return the
+// counters it is given
+func (O *OwnedCounter) Walk(fn func(id int, owner interface{}) bool) {
+	ids := make([]int, 0, len(O.owner))
+	for id := range O.owner {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		owner, ok := O.owner[id]
+		if ok && fn(id, owner) == false {
+			return
+		}
+	}
+}
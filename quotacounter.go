@@ -0,0 +1,178 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright Copyright (c) 2022 NetLOX Inc
+
+package loxilib
+
+import (
+	"errors"
+)
+
+// QuotaUnlimited - Limit of a quota node without a cap of its own
+const QuotaUnlimited = -1
+
+// ErrQuota - Error returned when an allocation would exceed a quota, as
+// opposed to "Overflow" when the shared counter itself is exhausted
+var ErrQuota = errors.New("Quota")
+
+// QuotaNode - A node in a tree of quotas like cluster, tenant and service
+// Counters charged to a node are charged to all of its ancestors too.
+// Limits of children may add up to more than the limit of their parent,
+// the parent limit is then enforced as the children allocate
+type QuotaNode struct {
+	name   string
+	limit  int
+	used   int
+	parent *QuotaNode
+	child  map[string]*QuotaNode
+}
+
+// QuotaCounter - Counter shared by a tree of quota nodes
+type QuotaCounter struct {
+	c      *Counter
+	root   *QuotaNode
+	charge map[int]*QuotaNode
+}
+
+// NewQuotaCounter - Add quotas over counter c
+// c should be used only through the QuotaCounter afterwards. Root quota node
+// is unlimited, the counter capacity being its natural limit
+func NewQuotaCounter(c *Counter) *QuotaCounter {
+	Q := new(QuotaCounter)
+	Q.c = c
+	Q.root = &QuotaNode{limit: QuotaUnlimited, child: make(map[string]*QuotaNode)}
+	Q.charge = make(map[int]*QuotaNode)
+	return Q
+}
+
+// Root - Get the root quota node
+func (Q *QuotaCounter) Root() *QuotaNode {
+	return Q.root
+}
+
+// AddQuota - Add a child quota node with limit counters
+// returns the new node or error
+func (N *QuotaNode) AddQuota(name string, limit int) (*QuotaNode, error) {
+	if limit < QuotaUnlimited {
+		return nil, errors.New("Range")
+	}
+	if _, ok := N.child[name]; ok {
+		return nil, errors.New("Exists")
+	}
+	n := &QuotaNode{name: name, limit: limit, parent: N, child: make(map[string]*QuotaNode)}
+	N.child[name] = n
+	return n, nil
+}
+
+// DelQuota - Delete a child quota node which has no counters charged
+// returns nil on success or error
+func (N *QuotaNode) DelQuota(name string) error {
+	n, ok := N.child[name]
+	if !ok {
+		return errors.New("NotFound")
+	}
+	if n.used > 0 {
+		return errors.New("Busy")
+	}
+	delete(N.child, name)
+	n.parent = nil
+	return nil
+}
+
+// Quota - Get a child quota node by name or nil if not found
+func (N *QuotaNode) Quota(name string) *QuotaNode {
+	return N.child[name]
+}
+
+// Name - Get the name of a quota node
+func (N *QuotaNode) Name() string {
+	return N.name
+}
+
+// Used - Get the number of counters charged to a quota node and its children
+func (N *QuotaNode) Used() int {
+	return N.used
+}
+
+// Limit - Get the limit of a quota node
+func (N *QuotaNode) Limit() int {
+	return N.limit
+}
+
+// SetLimit - Change the limit of a quota node
+// A limit below current usage only stops further allocations
+func (N *QuotaNode) SetLimit(limit int) error {
+	if limit < QuotaUnlimited {
+		return errors.New("Range")
+	}
+	N.limit = limit
+	return nil
+}
+
+// check verifies that n and its ancestors can take one more counter
+func (Q *QuotaCounter) check(n *QuotaNode) error {
+	if n == nil {
+		return errors.New("NotFound")
+	}
+	for p := n; p != nil; p = p.parent {
+		if p.parent == nil && p != Q.root {
+			return errors.New("NotFound")
+		}
+		if p.limit != QuotaUnlimited && p.used >= p.limit {
+			return ErrQuota
+		}
+	}
+	return nil
+}
+
+func (Q *QuotaCounter) account(id int, n *QuotaNode, v int) {
+	for p := n; p != nil; p = p.parent {
+		p.used += v
+	}
+	if v > 0 {
+		Q.charge[id] = n
+	} else {
+		delete(Q.charge, id)
+	}
+}
+
+// GetCounter - Get next available counter charged to quota node n
+// returns counter or ErrQuota if a quota is exceeded or other error
+func (Q *QuotaCounter) GetCounter(n *QuotaNode) (int, error) {
+	if err := Q.check(n); err != nil {
+		return -1, err
+	}
+	id, err := Q.c.GetCounter()
+	if err != nil {
+		return id, err
+	}
+	Q.account(id, n, 1)
+	return id, nil
+}
+
+// ReserveCounter - Allocate a specific counter charged to quota node n
+// returns nil on success, ErrQuota if a quota is exceeded or other error
+func (Q *QuotaCounter) ReserveCounter(n *QuotaNode, id int) error {
+	if err := Q.check(n); err != nil {
+		return err
+	}
+	if err := Q.c.ReserveCounter(id); err != nil {
+		return err
+	}
+	Q.account(id, n, 1)
+	return nil
+}
+
+// PutCounter - Return a counter and release its charge on quota nodes
+func (Q *QuotaCounter) PutCounter(id int) error {
+	if err := Q.c.PutCounter(id); err != nil {
+		return err
+	}
+	Q.account(id, Q.charge[id], -1)
+	return nil
+}
+
+// QuotaOf - Get the quota node a counter is charged to
+// returns the node or nil if the counter is not allocated
+func (Q *QuotaCounter) QuotaOf(id int) *QuotaNode {
+	return Q.charge[id]
+}
@@ -0,0 +1,223 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright Copyright (c) 2022 NetLOX Inc
+
+package loxilib
+
+import (
+	"errors"
+	"math/bits"
+)
+
+// sparseNode - node of a 64-ary tree of bitmaps
+// In leaves, full has a bit per counter. In other nodes, full has a bit per
+// child which is completely allocated and used a bit per child which has
+// any allocation. Children without allocations are not kept
+type sparseNode struct {
+	full  uint64
+	used  uint64
+	child []*sparseNode
+}
+
+// SparseCounter - Counter for large counter spaces
+// Memory use follows the number of allocated counters rather than the size
+// of the space and finding a free counter takes O(log n). Lowest free
+// counter is handed out first
+type SparseCounter struct {
+	begin  int
+	len    int
+	inUse  int
+	height int
+	root   *sparseNode
+}
+
+// NewSparseCounter - Allocate a sparse set of counters
+func NewSparseCounter(begin int, length int) *SparseCounter {
+	S := new(SparseCounter)
+	S.begin = begin
+	S.len = length
+	for S.height < 10 && length > 1<<(6*(S.height+1)) {
+		S.height++
+	}
+	S.root = new(sparseNode)
+	return S
+}
+
+func (n *sparseNode) empty() bool {
+	return n.full == 0 && n.used == 0
+}
+
+// set marks rid allocated in the subtree of n at height h
+// returns false if it was already allocated
+func (n *sparseNode) set(rid int, h int) bool {
+	i := uint(rid>>(6*h)) & 63
+	if n.full&(1<<i) != 0 {
+		return false
+	}
+	if h == 0 {
+		n.full |= 1 << i
+		return true
+	}
+	if n.child == nil {
+		n.child = make([]*sparseNode, 64)
+	}
+	c := n.child[i]
+	if c == nil {
+		c = new(sparseNode)
+		n.child[i] = c
+	}
+	if c.set(rid, h-1) == false {
+		return false
+	}
+	n.used |= 1 << i
+	if c.full == ^uint64(0) {
+		n.full |= 1 << i
+	}
+	return true
+}
+
+// clear marks rid free in the subtree of n at height h and drops subtrees
+// left without allocations
+// returns false if it was not allocated
+func (n *sparseNode) clear(rid int, h int) bool {
+	i := uint(rid>>(6*h)) & 63
+	if h == 0 {
+		if n.full&(1<<i) == 0 {
+			return false
+		}
+		n.full &^= 1 << i
+		return true
+	}
+	if n.child == nil || n.child[i] == nil {
+		return false
+	}
+	c := n.child[i]
+	if c.clear(rid, h-1) == false {
+		return false
+	}
+	n.full &^= 1 << i
+	if c.empty() == true {
+		n.child[i] = nil
+		n.used &^= 1 << i
+		if n.used == 0 {
+			n.child = nil
+		}
+	}
+	return true
+}
+
+// lowestFree returns the lowest free rid, there has to be one
+func (S *SparseCounter) lowestFree() int {
+	rid := 0
+	n := S.root
+	for h := S.height; ; h-- {
+		i := bits.TrailingZeros64(^n.full)
+		rid |= i << (6 * h)
+		if h == 0 || n.child == nil || n.child[i] == nil {
+			return rid
+		}
+		n = n.child[i]
+	}
+}
+
+// nextFree returns the first free rid at or after from in the subtree of n
+// at height h or -1 if none, rids are relative to the subtree
+func (n *sparseNode) nextFree(from int, h int) int {
+	shift := uint(6 * h)
+	first := from >> shift
+	for i := first; i < 64; i++ {
+		if n.full&(1<<uint(i)) != 0 {
+			continue
+		}
+		lo := 0
+		if i == first {
+			lo = from & (1<<shift - 1)
+		}
+		if h == 0 || n.child == nil || n.child[i] == nil {
+			return i<<shift | lo
+		}
+		if rid := n.child[i].nextFree(lo, h-1); rid != -1 {
+			return i<<shift | rid
+		}
+	}
+	return -1
+}
+
+// GetCounterFrom - Get first available counter at or after id
+// Search wraps around to the beginning, starting from a random id gives
+// randomized allocation like RFC 6056 simple port randomization
+func (S *SparseCounter) GetCounterFrom(id int) (int, error) {
+	if id < S.begin || id >= S.begin+S.len {
+		return -1, errors.New("Range")
+	}
+	if S.inUse >= S.len {
+		return -1, errors.New("Overflow")
+	}
+	rid := S.root.nextFree(id-S.begin, S.height)
+	if rid == -1 || rid >= S.len {
+		rid = S.lowestFree()
+	}
+	S.root.set(rid, S.height)
+	S.inUse++
+	return rid + S.begin, nil
+}
+
+// GetCounter - Get lowest available counter
+func (S *SparseCounter) GetCounter() (int, error) {
+	if S.inUse >= S.len {
+		return -1, errors.New("Overflow")
+	}
+	rid := S.lowestFree()
+	S.root.set(rid, S.height)
+	S.inUse++
+	return rid + S.begin, nil
+}
+
+// PutCounter - Return a counter to the available set
+// returning a counter which is not allocated is an error
+func (S *SparseCounter) PutCounter(id int) error {
+	if id < S.begin || id >= S.begin+S.len {
+		return errors.New("Range")
+	}
+	if S.root.clear(id-S.begin, S.height) == false {
+		return errors.New("NotAllocated")
+	}
+	S.inUse--
+	return nil
+}
+
+// ReserveCounter - Allocate a specific counter if it is available
+// returns nil on success or error
+func (S *SparseCounter) ReserveCounter(id int) error {
+	if id < S.begin || id >= S.begin+S.len {
+		return errors.New("Range")
+	}
+	if S.root.set(id-S.begin, S.height) == false {
+		return errors.New("Busy")
+	}
+	S.inUse++
+	return nil
+}
+
+// IsAllocated - Check whether a counter is currently allocated
+func (S *SparseCounter) IsAllocated(id int) bool {
+	if id < S.begin || id >= S.begin+S.len {
+		return false
+	}
+	rid := id - S.begin
+	n := S.root
+	for h := S.height; ; h-- {
+		i := uint(rid>>(6*h)) & 63
+		if n.full&(1<<i) != 0 {
+			return true
+		}
+		if h == 0 || n.child == nil || n.child[i] == nil {
+			return false
+		}
+		n = n.child[i]
+	}
+}
+
+// InUse - Get the number of allocated counters
+func (S *SparseCounter) InUse() int {
+	return S.inUse
+}
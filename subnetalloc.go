@@ -0,0 +1,207 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright Copyright (c) 2022 NetLOX Inc
+
+package loxilib
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sort"
+)
+
+// SubnetAlloc - context container for a subnet allocator
+// Sub-prefixes of a parent cidr are handed out buddy-allocator style.
+// Free blocks are kept per prefix length and allocations are tracked in a
+// trie so that owner of any address can be looked up
+type SubnetAlloc struct {
+	v6     bool
+	pfxLen int
+	maxLen int
+	parent trieVar
+	free   []subnetFree
+	owners *TrieRoot
+}
+
+// subnetFree - free blocks of a prefix length kept in address order
+type subnetFree []trieVar
+
+func (f subnetFree) search(tv trieVar) (int, bool) {
+	i := sort.Search(len(f), func(i int) bool {
+		return bytes.Compare(f[i].prefix[:], tv.prefix[:]) >= 0
+	})
+	return i, i < len(f) && f[i] == tv
+}
+
+func (f *subnetFree) add(tv trieVar) {
+	i, _ := f.search(tv)
+	*f = append(*f, trieVar{})
+	copy((*f)[i+1:], (*f)[i:])
+	(*f)[i] = tv
+}
+
+func (f *subnetFree) remove(tv trieVar) bool {
+	i, found := f.search(tv)
+	if found == false {
+		return false
+	}
+	*f = append((*f)[:i], (*f)[i+1:]...)
+	return true
+}
+
+// NewSubnetAlloc - Create a subnet allocator for the parent cidr
+func NewSubnetAlloc(parent string) (*SubnetAlloc, error) {
+	var tv trieVar
+
+	pfxLen, hostBits := cidr2TrieVarExt(parent, &tv)
+	if pfxLen < 0 || hostBits == true {
+		return nil, errors.New("Prefix")
+	}
+
+	S := new(SubnetAlloc)
+	S.v6 = cidrIsV6(parent)
+	S.owners = TrieInit(S.v6)
+	S.maxLen = S.owners.keyBits()
+	S.pfxLen = pfxLen
+	S.parent = tv
+	S.free = make([]subnetFree, S.maxLen+1)
+	S.free[pfxLen].add(tv)
+	return S, nil
+}
+
+func (S *SubnetAlloc) maskTv(tv trieVar, pfxLen int) trieVar {
+	for i := pfxLen; i < S.maxLen; i++ {
+		tv.unSetBit(i)
+	}
+	return tv
+}
+
+func (S *SubnetAlloc) parseSubnet(cidr string, tv *trieVar) (int, error) {
+	pfxLen, hostBits := cidr2TrieVarExt(cidr, tv)
+	if pfxLen < 0 || hostBits == true || cidrIsV6(cidr) != S.v6 {
+		return -1, errors.New("Prefix")
+	}
+	if pfxLen < S.pfxLen || S.maskTv(*tv, S.pfxLen) != S.parent {
+		return -1, errors.New("Range")
+	}
+	return pfxLen, nil
+}
+
+// split breaks free block tv of length pfxLen down to length toLen along
+// the path of tv, returning the buddies on the way to free lists
+func (S *SubnetAlloc) split(tv trieVar, pfxLen int, toLen int) {
+	for l := pfxLen; l < toLen; l++ {
+		buddy := tv
+		if tv.bit(l) == 1 {
+			buddy.unSetBit(l)
+		} else {
+			buddy.setBit(l)
+		}
+		S.free[l+1].add(buddy)
+	}
+}
+
+// AllocSubnet - Allocate a free subnet of given prefix length for owner
+// Smallest free block that fits is used and split if needed, among blocks
+// of the same size the one with lowest address is used. owner is any
+// user-defined non-zero data which can be looked up with FindSubnetOwner
+// returns the allocated subnet or error
+func (S *SubnetAlloc) AllocSubnet(pfxLen int, owner TrieData) (*net.IPNet, error) {
+	if pfxLen < S.pfxLen || pfxLen > S.maxLen {
+		return nil, errors.New("Range")
+	}
+
+	for l := pfxLen; l >= S.pfxLen; l-- {
+		if len(S.free[l]) == 0 {
+			continue
+		}
+		tv := S.free[l][0]
+		S.free[l].remove(tv)
+		S.split(tv, l, pfxLen)
+		if ret := S.owners.addTrieVar(&tv, pfxLen, owner); ret != 0 {
+			return nil, errors.New("Trie")
+		}
+		return trieVar2IPNet(&tv, pfxLen, S.v6), nil
+	}
+
+	return nil, errors.New("Exhausted")
+}
+
+// ReserveSubnet - Reserve a specific subnet for owner
+// The subnet needs to lie within the parent and be completely free
+// returns nil on success or error
+func (S *SubnetAlloc) ReserveSubnet(cidr string, owner TrieData) error {
+	var tv trieVar
+
+	pfxLen, err := S.parseSubnet(cidr, &tv)
+	if err != nil {
+		return err
+	}
+
+	for l := pfxLen; l >= S.pfxLen; l-- {
+		ftv := S.maskTv(tv, l)
+		if S.free[l].remove(ftv) == true {
+			S.split(tv, l, pfxLen)
+			if ret := S.owners.addTrieVar(&tv, pfxLen, owner); ret != 0 {
+				return errors.New("Trie")
+			}
+			return nil
+		}
+	}
+
+	return errors.New("Busy")
+}
+
+// ReleaseSubnet - Release an allocated or reserved subnet
+// Released block is coalesced with its free buddies
+// returns nil on success or error
+func (S *SubnetAlloc) ReleaseSubnet(cidr string) error {
+	var tv trieVar
+
+	pfxLen, err := S.parseSubnet(cidr, &tv)
+	if err != nil {
+		return err
+	}
+
+	if _, found := S.owners.findExactInt(&tv, pfxLen); found == false {
+		return errors.New("NoEnt")
+	}
+	if S.owners.delTrieVar(&tv, pfxLen) != 0 {
+		return errors.New("Trie")
+	}
+
+	for ; pfxLen > S.pfxLen; pfxLen-- {
+		buddy := tv
+		if tv.bit(pfxLen-1) == 1 {
+			buddy.unSetBit(pfxLen - 1)
+		} else {
+			buddy.setBit(pfxLen - 1)
+		}
+		if S.free[pfxLen].remove(buddy) == false {
+			break
+		}
+		tv.unSetBit(pfxLen - 1)
+	}
+	S.free[pfxLen].add(tv)
+	return nil
+}
+
+// FindSubnetOwner - Find the allocated subnet holding an IP address
+// returns the subnet, its owner or error if address is not allocated
+func (S *SubnetAlloc) FindSubnetOwner(IP string) (*net.IPNet, TrieData, error) {
+	ret, ipn, owner := S.owners.FindTrie(IP)
+	if ret != 0 {
+		return nil, nil, errors.New("NoEnt")
+	}
+	return ipn, owner, nil
+}
+
+// SubnetFreeCount - Number of free blocks of each prefix length
+// returns a slice indexed by prefix length
+func (S *SubnetAlloc) SubnetFreeCount() []int {
+	cnt := make([]int, S.maxLen+1)
+	for l := range S.free {
+		cnt[l] = len(S.free[l])
+	}
+	return cnt
+}
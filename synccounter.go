@@ -0,0 +1,156 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright Copyright (c) 2022 NetLOX Inc
+
+package loxilib
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// SyncCounter - Counter which is safe for concurrent use
+type SyncCounter struct {
+	mtx sync.Mutex
+	c   *Counter
+}
+
+// NewSyncCounter - Allocate a set of counters safe for concurrent use
+func NewSyncCounter(begin int, length int) *SyncCounter {
+	return &SyncCounter{c: NewCounter(begin, length)}
+}
+
+// GetCounter - Get next available counter
+func (S *SyncCounter) GetCounter() (int, error) {
+	S.mtx.Lock()
+	defer S.mtx.Unlock()
+	return S.c.GetCounter()
+}
+
+// PutCounter - Return a counter to the available list
+func (S *SyncCounter) PutCounter(id int) error {
+	S.mtx.Lock()
+	defer S.mtx.Unlock()
+	return S.c.PutCounter(id)
+}
+
+// ReserveCounter - Allocate a specific counter if it is available
+func (S *SyncCounter) ReserveCounter(id int) error {
+	S.mtx.Lock()
+	defer S.mtx.Unlock()
+	return S.c.ReserveCounter(id)
+}
+
+// IsAllocated - Check whether a counter is currently allocated
+func (S *SyncCounter) IsAllocated(id int) bool {
+	S.mtx.Lock()
+	defer S.mtx.Unlock()
+	return S.c.IsAllocated(id)
+}
+
+// Do - Run fn with exclusive access to the underlying Counter
+// This gives access to Counter operations not wrapped by SyncCounter
+func (S *SyncCounter) Do(fn func(c *Counter)) {
+	S.mtx.Lock()
+	defer S.mtx.Unlock()
+	fn(S.c)
+}
+
+type counterShard struct {
+	mtx   sync.Mutex
+	begin int
+	c     *Counter
+	// Keep shards on separate cache lines
+	_ [40]byte
+}
+
+// ShardedCounter - Counter split into independently locked shards
+// Each shard owns a contiguous part of the ID space with its own free list.
+// Allocations go to a home shard and steal from other shards once the home
+// shard runs dry, so that concurrent allocators rarely contend
+type ShardedCounter struct {
+	begin  int
+	len    int
+	rr     uint32
+	shards []counterShard
+}
+
+// NewShardedCounter - Allocate a set of counters split in nShards shards
+func NewShardedCounter(begin int, length int, nShards int) *ShardedCounter {
+	if nShards <= 0 {
+		nShards = 1
+	}
+	if nShards > length {
+		nShards = length
+	}
+
+	S := new(ShardedCounter)
+	S.begin = begin
+	S.len = length
+	S.shards = make([]counterShard, nShards)
+	sBegin := begin
+	for i := range S.shards {
+		sLen := length / nShards
+		if i < length%nShards {
+			sLen++
+		}
+		S.shards[i].begin = sBegin
+		S.shards[i].c = NewCounter(sBegin, sLen)
+		sBegin += sLen
+	}
+	return S
+}
+
+func (S *ShardedCounter) shardOf(id int) *counterShard {
+	i := sort.Search(len(S.shards), func(i int) bool {
+		return S.shards[i].begin > id
+	})
+	return &S.shards[i-1]
+}
+
+// GetCounterShard - Get next available counter preferring shard hint
+// hint is usually an identifier of the caller, like a worker index, so
+// that each caller sticks to its own shard
+func (S *ShardedCounter) GetCounterShard(hint int) (int, error) {
+	n := uint(len(S.shards))
+	home := uint(hint) % n
+	for i := uint(0); i < n; i++ {
+		sh := &S.shards[(home+i)%n]
+		sh.mtx.Lock()
+		id, err := sh.c.GetCounter()
+		sh.mtx.Unlock()
+		if err == nil {
+			return id, nil
+		}
+	}
+	return -1, errors.New("Overflow")
+}
+
+// GetCounter - Get next available counter
+// Home shard is chosen round-robin
+func (S *ShardedCounter) GetCounter() (int, error) {
+	return S.GetCounterShard(int(atomic.AddUint32(&S.rr, 1) % uint32(len(S.shards))))
+}
+
+// PutCounter - Return a counter to the available list of its shard
+func (S *ShardedCounter) PutCounter(id int) error {
+	if id < S.begin || id >= S.begin+S.len {
+		return errors.New("Range")
+	}
+	sh := S.shardOf(id)
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+	return sh.c.PutCounter(id)
+}
+
+// IsAllocated - Check whether a counter is currently allocated
+func (S *ShardedCounter) IsAllocated(id int) bool {
+	if id < S.begin || id >= S.begin+S.len {
+		return false
+	}
+	sh := S.shardOf(id)
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+	return sh.c.IsAllocated(id)
+}
@@ -7,6 +7,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math/bits"
 	"net"
 )
 
@@ -19,6 +20,7 @@ const (
 	TrieErrNoMem
 	TrieErrUnknown
 	TrieErrPrefix
+	TrieErrHostBits
 )
 
 // constants
@@ -28,6 +30,7 @@ const (
 	PrefixArrNbits  = ((PrefixArrLenfth + TrieJmpLength) & ^TrieJmpLength) / TrieJmpLength
 	PtrArrLength    = (1 << TrieJmpLength)
 	PtrArrNBits     = ((PtrArrLength + TrieJmpLength) & ^TrieJmpLength) / TrieJmpLength
+	TrieMaxKeyLen   = 16 // Max key length in bytes, same as an IPv6 address
 )
 
 // TrieData - Any user data to be associated with a trie node
@@ -43,7 +46,13 @@ type TrieIterIntf interface {
 }
 
 type trieVar struct {
-	prefix [16]byte
+	prefix [TrieMaxKeyLen]byte
+}
+
+// trieKey - identifies a prefix in the trie
+type trieKey struct {
+	tv     trieVar
+	pfxLen int
 }
 
 type trieState struct {
@@ -60,6 +69,10 @@ type trieState struct {
 // TrieRoot - root of a trie data structure
 type TrieRoot struct {
 	v6         bool
+	strict     bool
+	keyLen     int
+	exp        *trieExpiry
+	rIdx       *trieRevIndex
 	prefixArr  [PrefixArrNbits]uint8
 	ptrArr     [PtrArrNBits]uint8
 	prefixData [PrefixArrLenfth]TrieData
@@ -73,6 +86,22 @@ func TrieInit(v6 bool) *TrieRoot {
 	return root
 }
 
+// TrieInitKey - Initialize a trie root for bit-string keys
+// Such a trie holds prefixes of raw keys (e.g. MAC addresses, MPLS labels or
+// composite keys) of up to maxKeyBits bits, which can be at most
+// 8*TrieMaxKeyLen. Keys share the node storage of IP tries so that the
+// max is kept at the size of an IPv6 address. Entries are managed with AddTrieKey, DelTrieKey and
+// FindTrieKey
+// returns the trie root or nil if maxKeyBits is out of range
+func TrieInitKey(maxKeyBits int) *TrieRoot {
+	if maxKeyBits <= 0 || maxKeyBits > 8*TrieMaxKeyLen {
+		return nil
+	}
+	var root = new(TrieRoot)
+	root.keyLen = maxKeyBits
+	return root
+}
+
 func prefix2TrieVar(ipPrefix net.IP, pIndex int) trieVar {
 	var tv trieVar
 
@@ -93,7 +122,7 @@ func prefix2TrieVar(ipPrefix net.IP, pIndex int) trieVar {
 
 func grabByte(tv *trieVar, pIndex int) (uint8, error) {
 
-	if pIndex > 15 {
+	if pIndex >= TrieMaxKeyLen {
 		return 0xff, errors.New("Out of range")
 	}
 
@@ -101,15 +130,27 @@ func grabByte(tv *trieVar, pIndex int) (uint8, error) {
 }
 
 func cidr2TrieVar(cidr string, tv *trieVar) (pfxLen int) {
-	_, ipNet, err := net.ParseCIDR(cidr)
+	pfxLen, _ = cidr2TrieVarExt(cidr, tv)
+	return pfxLen
+}
+
+// cidr2TrieVarExt - same as cidr2TrieVar but also tells whether the
+// address had host bits set beyond the prefix length, which get masked
+func cidr2TrieVarExt(cidr string, tv *trieVar) (pfxLen int, hostBits bool) {
+	ip, ipNet, err := net.ParseCIDR(cidr)
 	if err != nil {
-		return -1
+		return -1, false
 	}
 
 	pfx := ipNet.IP.Mask(ipNet.Mask)
 	pfxLen, _ = ipNet.Mask.Size()
 	*tv = prefix2TrieVar(pfx, 0)
-	return pfxLen
+	return pfxLen, !ip.Equal(pfx)
+}
+
+func cidrIsV6(cidr string) bool {
+	ip, _, err := net.ParseCIDR(cidr)
+	return err == nil && ip.To4() == nil
 }
 
 func shrinkPrefixArrDat(arr []TrieData, startPos int) {
@@ -290,8 +331,7 @@ func (t *TrieRoot) findTrieInt(tv *trieVar, currLevel int, ts *trieState) int {
 		shftBits := TrieJmpLength - rPfxLen
 		basePos := (1 << rPfxLen) - 1
 		// Find value relevant to currently remaining prefix len
-		cval = cval >> shftBits
-		idx = basePos + int(cval)
+		idx = basePos + int(cval>>shftBits)
 		pfxVal := (idx - basePos) << shftBits
 
 		if IsBitSetInArr(t.prefixArr[:], idx) == true {
@@ -377,25 +417,176 @@ func (t *TrieRoot) walkTrieInt(tv *trieVar, level int, ts *trieState, tf TrieIte
 	return 0
 }
 
+func (t *TrieRoot) addTrieVar(tv *trieVar, pfxLen int, data TrieData) int {
+	var ts = trieState{data, 0, 0, false, trieVar{}, false, 4, 0}
+
+	ret := t.addTrieInt(tv, 0, pfxLen, &ts)
+	if ret != 0 || ts.errCode != 0 {
+		return ret
+	}
+
+	if t.rIdx != nil {
+		t.rIdx.add(trieKey{*tv, pfxLen}, data)
+	}
+
+	return 0
+}
+
+func (t *TrieRoot) delTrieVar(tv *trieVar, pfxLen int) int {
+	var ts = trieState{0, 0, 0, false, trieVar{}, false, 4, 0}
+	var data TrieData
+	var found bool
+
+	if t.rIdx != nil {
+		data, found = t.findExactInt(tv, pfxLen)
+	}
+
+	ret := t.deleteTrieInt(tv, 0, pfxLen, &ts)
+	if ret != 0 || ts.errCode != 0 {
+		return TrieErrNoEnt
+	}
+
+	if t.exp != nil {
+		t.exp.remove(trieKey{*tv, pfxLen})
+	}
+
+	if found == true {
+		t.rIdx.remove(trieKey{*tv, pfxLen}, data)
+	}
+
+	return 0
+}
+
+// walkEntriesInt calls fn for each prefix stored in the trie along with
+// its prefix length and user-defined data. Walk stops once fn returns false
+func (t *TrieRoot) walkEntriesInt(tv *trieVar, level int, fn func(tv *trieVar, pfxLen int, data TrieData) bool) bool {
+	pfxIdx := 0
+	for p := 0; p < PrefixArrLenfth; p++ {
+		if IsBitSetInArr(t.prefixArr[:], p) == false {
+			continue
+		}
+		pfxLen := bits.Len(uint(p+1)) - 1
+		basePos := (1 << pfxLen) - 1
+		etv := *tv
+		etv.prefix[level] = byte((p - basePos) << (TrieJmpLength - pfxLen))
+		for i := level + 1; i < len(etv.prefix); i++ {
+			etv.prefix[i] = 0
+		}
+		if fn(&etv, level*TrieJmpLength+pfxLen, t.prefixData[pfxIdx]) == false {
+			return false
+		}
+		pfxIdx++
+	}
+
+	ptrIdx := 0
+	for p := 0; p < PtrArrLength; p++ {
+		if IsBitSetInArr(t.ptrArr[:], p) == false {
+			continue
+		}
+		if nextRoot := t.ptrData[ptrIdx]; nextRoot != nil {
+			tv.prefix[level] = byte(p)
+			if nextRoot.walkEntriesInt(tv, level+1, fn) == false {
+				return false
+			}
+		}
+		ptrIdx++
+	}
+	return true
+}
+
+// findCoveringInt calls fn for every prefix in the trie which covers the
+// prefix given by tv and pfxLen, including the prefix itself if present
+func (t *TrieRoot) findCoveringInt(tv *trieVar, level int, pfxLen int, fn func(pfxLen int, data TrieData)) {
+	cval := tv.prefix[level]
+
+	for rPfxLen := 0; rPfxLen <= TrieJmpLength; rPfxLen++ {
+		if level*TrieJmpLength+rPfxLen > pfxLen {
+			return
+		}
+		idx := (1 << rPfxLen) - 1 + int(cval>>(TrieJmpLength-rPfxLen))
+		if IsBitSetInArr(t.prefixArr[:], idx) == true {
+			pfxIdx := CountSetBitsInArr(t.prefixArr[:], idx-1)
+			fn(level*TrieJmpLength+rPfxLen, t.prefixData[pfxIdx])
+		}
+	}
+
+	if pfxLen <= (level+1)*TrieJmpLength || IsBitSetInArr(t.ptrArr[:], int(cval)) == false {
+		return
+	}
+	ptrIdx := CountSetBitsInArr(t.ptrArr[:], int(cval)-1)
+	if nextRoot := t.ptrData[ptrIdx]; nextRoot != nil {
+		nextRoot.findCoveringInt(tv, level+1, pfxLen, fn)
+	}
+}
+
+// findExactInt looks up data of the prefix given by tv and pfxLen
+// returns the data and whether the prefix exists in the trie
+func (t *TrieRoot) findExactInt(tv *trieVar, pfxLen int) (TrieData, bool) {
+	var found = false
+	var fData TrieData
+
+	t.findCoveringInt(tv, 0, pfxLen, func(fPfxLen int, data TrieData) {
+		if fPfxLen == pfxLen {
+			fData = data
+			found = true
+		}
+	})
+	return fData, found
+}
+
+func (t *TrieRoot) keyBits() int {
+	if t.keyLen > 0 {
+		return t.keyLen
+	}
+	if t.v6 == true {
+		return 128
+	}
+	return 32
+}
+
+func (tv *trieVar) bit(pos int) int {
+	return int(tv.prefix[pos/8]>>(7-pos%8)) & 0x1
+}
+
+func (tv *trieVar) setBit(pos int) {
+	tv.prefix[pos/8] |= 0x80 >> (pos % 8)
+}
+
+func (tv *trieVar) unSetBit(pos int) {
+	tv.prefix[pos/8] &= ^uint8(0x80 >> (pos % 8))
+}
+
+func trieVar2IPNet(tv *trieVar, pfxLen int, v6 bool) *net.IPNet {
+	var ipnet net.IPNet
+	if v6 == false {
+		ipnet.IP = net.IPv4(tv.prefix[0], tv.prefix[1], tv.prefix[2], tv.prefix[3]).To4()
+		ipnet.Mask = net.CIDRMask(pfxLen, 32)
+	} else {
+		ipnet.IP = make(net.IP, net.IPv6len)
+		copy(ipnet.IP, tv.prefix[:net.IPv6len])
+		ipnet.Mask = net.CIDRMask(pfxLen, 128)
+	}
+	ipnet.IP = ipnet.IP.Mask(ipnet.Mask)
+	return &ipnet
+}
+
 // AddTrie - Add a trie entry
 // cidr is the route in cidr format and data is any user-defined data
 // returns 0 on success or non-zero error code on error
 func (t *TrieRoot) AddTrie(cidr string, data TrieData) int {
 	var tv trieVar
-	var ts = trieState{data, 0, 0, false, trieVar{}, false, 4, 0}
 
-	pfxLen := cidr2TrieVar(cidr, &tv)
+	pfxLen, hostBits := cidr2TrieVarExt(cidr, &tv)
 
-	if pfxLen < 0 {
+	if pfxLen < 0 || t.keyLen > 0 {
 		return TrieErrPrefix
 	}
 
-	ret := t.addTrieInt(&tv, 0, pfxLen, &ts)
-	if ret != 0 || ts.errCode != 0 {
-		return ret
+	if hostBits == true && t.strict == true {
+		return TrieErrHostBits
 	}
 
-	return 0
+	return t.addTrieVar(&tv, pfxLen, data)
 }
 
 // DelTrie - Delete a trie entry
@@ -403,20 +594,14 @@ func (t *TrieRoot) AddTrie(cidr string, data TrieData) int {
 // returns 0 on success or non-zero error code on error
 func (t *TrieRoot) DelTrie(cidr string) int {
 	var tv trieVar
-	var ts = trieState{0, 0, 0, false, trieVar{}, false, 4, 0}
 
 	pfxLen := cidr2TrieVar(cidr, &tv)
 
-	if pfxLen < 0 {
+	if pfxLen < 0 || t.keyLen > 0 {
 		return TrieErrPrefix
 	}
 
-	ret := t.deleteTrieInt(&tv, 0, pfxLen, &ts)
-	if ret != 0 || ts.errCode != 0 {
-		return TrieErrNoEnt
-	}
-
-	return 0
+	return t.delTrieVar(&tv, pfxLen)
 }
 
 // FindTrie - Lookup matching route as per longest prefix match
@@ -437,7 +622,7 @@ func (t *TrieRoot) FindTrie(IP string) (int, *net.IPNet, TrieData) {
 	}
 	pfxLen := cidr2TrieVar(cidr, &tv)
 
-	if pfxLen < 0 {
+	if pfxLen < 0 || t.keyLen > 0 {
 		return TrieErrPrefix, nil, 0
 	}
 
@@ -450,18 +635,208 @@ func (t *TrieRoot) FindTrie(IP string) (int, *net.IPNet, TrieData) {
 				res = append(res, ts.lastMatchTv.prefix[i])
 			}
 			mask := net.CIDRMask(ts.lastMatchPfxLen, 32)
-			ipnet := net.IPNet{IP: res, Mask: mask}
+			ipnet := net.IPNet{IP: res.Mask(mask), Mask: mask}
 			return 0, &ipnet, ts.trieData
 		} else {
-			var res net.IP = ts.lastMatchTv.prefix[:]
+			var res net.IP = ts.lastMatchTv.prefix[:net.IPv6len]
 			mask := net.CIDRMask(ts.lastMatchPfxLen, 128)
-			ipnet := net.IPNet{IP: res, Mask: mask}
+			ipnet := net.IPNet{IP: res.Mask(mask), Mask: mask}
 			return 0, &ipnet, ts.trieData
 		}
 	}
 	return TrieErrNoEnt, nil, 0
 }
 
+// TrieBatchMax - number of addresses walked together by FindTrieBatch
+const TrieBatchMax = 256
+
+func (t *TrieRoot) matchPrefixInt(cval uint8) (int, TrieData) {
+	for rPfxLen := TrieJmpLength; rPfxLen >= 0; rPfxLen-- {
+		idx := (1 << rPfxLen) - 1 + int(cval>>(TrieJmpLength-rPfxLen))
+		if IsBitSetInArr(t.prefixArr[:], idx) == true {
+			pfxIdx := CountSetBitsInArr(t.prefixArr[:], idx-1)
+			return rPfxLen, t.prefixData[pfxIdx]
+		}
+	}
+	return -1, nil
+}
+
+func (t *TrieRoot) findTrieBatchInt(IPs []net.IP, pfxLens []int, data []TrieData, found []bool) int {
+	var nodes [TrieBatchMax]*TrieRoot
+	var keys [TrieBatchMax][]byte
+	var active int
+	var nFound int
+
+	for i, ip := range IPs {
+		found[i] = false
+		pfxLens[i] = 0
+		data[i] = nil
+		if t.v6 == false {
+			keys[i] = ip.To4()
+		} else if len(ip) == net.IPv6len && ip.To4() == nil {
+			keys[i] = ip
+		} else {
+			keys[i] = nil
+		}
+		if keys[i] == nil {
+			nodes[i] = nil
+			continue
+		}
+		nodes[i] = t
+		active++
+	}
+
+	// Walk all addresses one trie level at a time so that nodes near
+	// the root are visited back to back while still hot in cache
+	for level := 0; active > 0; level++ {
+		for i := range IPs {
+			node := nodes[i]
+			if node == nil {
+				continue
+			}
+			cval := keys[i][level]
+			if rPfxLen, d := node.matchPrefixInt(cval); rPfxLen >= 0 {
+				if found[i] == false {
+					nFound++
+				}
+				pfxLens[i] = level*TrieJmpLength + rPfxLen
+				data[i] = d
+				found[i] = true
+			}
+			nodes[i] = nil
+			if level+1 < len(keys[i]) && IsBitSetInArr(node.ptrArr[:], int(cval)) == true {
+				ptrIdx := CountSetBitsInArr(node.ptrArr[:], int(cval)-1)
+				nodes[i] = node.ptrData[ptrIdx]
+			}
+			if nodes[i] == nil {
+				active--
+			}
+		}
+	}
+
+	return nFound
+}
+
+// FindTrieBatch - Lookup a batch of IP addresses as per longest prefix match
+// IPs is the list of addresses to lookup. For each address, pfxLens, data
+// and found are filled with the matching prefix length, user-defined data
+// and whether a match exists. These must be at least as long as IPs.
+// An address is looked up like FindTrie does with its string form, so an
+// IPv4 address (in 4 or 16 byte form) never matches in an IPv6 trie
+// returns number of addresses that matched or negative error code on error
+func (t *TrieRoot) FindTrieBatch(IPs []net.IP, pfxLens []int, data []TrieData, found []bool) int {
+	n := len(IPs)
+	if len(pfxLens) < n || len(data) < n || len(found) < n || t.keyLen > 0 {
+		return TrieErrGeneric
+	}
+
+	nFound := 0
+	for s := 0; s < n; s += TrieBatchMax {
+		e := s + TrieBatchMax
+		if e > n {
+			e = n
+		}
+		nFound += t.findTrieBatchInt(IPs[s:e], pfxLens[s:e], data[s:e], found[s:e])
+	}
+
+	return nFound
+}
+
+func (t *TrieRoot) key2TrieVar(key []byte, pfxLen int, tv *trieVar) (hostBits bool, ret int) {
+	if pfxLen < 0 || pfxLen > t.keyLen || 8*len(key) < pfxLen {
+		return false, TrieErrPrefix
+	}
+
+	nBits := 8 * copy(tv.prefix[:(t.keyLen+7)/8], key)
+	for i := pfxLen; i < nBits; i++ {
+		if tv.bit(i) == 1 {
+			// Bits beyond max key length are ignored
+			if i < t.keyLen {
+				hostBits = true
+			}
+			tv.unSetBit(i)
+		}
+	}
+	return hostBits, 0
+}
+
+// AddTrieKey - Add a trie entry for a bit-string key prefix
+// key holds the prefix bits starting from msb of key[0] and pfxLen is the
+// prefix length in bits. data is any user-defined data
+// returns 0 on success or non-zero error code on error
+func (t *TrieRoot) AddTrieKey(key []byte, pfxLen int, data TrieData) int {
+	var tv trieVar
+
+	if t.keyLen <= 0 {
+		return TrieErrPrefix
+	}
+
+	hostBits, ret := t.key2TrieVar(key, pfxLen, &tv)
+	if ret != 0 {
+		return ret
+	}
+
+	if hostBits == true && t.strict == true {
+		return TrieErrHostBits
+	}
+
+	return t.addTrieVar(&tv, pfxLen, data)
+}
+
+// DelTrieKey - Delete a trie entry for a bit-string key prefix
+// returns 0 on success or non-zero error code on error
+func (t *TrieRoot) DelTrieKey(key []byte, pfxLen int) int {
+	var tv trieVar
+
+	if t.keyLen <= 0 {
+		return TrieErrPrefix
+	}
+
+	if _, ret := t.key2TrieVar(key, pfxLen, &tv); ret != 0 {
+		return ret
+	}
+
+	if _, found := t.findExactInt(&tv, pfxLen); found == false {
+		return TrieErrNoEnt
+	}
+
+	return t.delTrieVar(&tv, pfxLen)
+}
+
+// FindTrieKey - Lookup a bit-string key as per longest prefix match
+// key needs to hold at least the max key bits of the trie
+// returns the following :
+// 1. 0 on success or non-zero error code on error
+// 2. length of matching prefix in bits
+// 3. user-defined data associated with the trie entry
+func (t *TrieRoot) FindTrieKey(key []byte) (int, int, TrieData) {
+	var tv trieVar
+	var ts = trieState{0, 0, 0, false, trieVar{}, false, 4, 0}
+
+	if t.keyLen <= 0 {
+		return TrieErrPrefix, 0, nil
+	}
+
+	if _, ret := t.key2TrieVar(key, t.keyLen, &tv); ret != 0 {
+		return ret, 0, nil
+	}
+
+	t.findTrieInt(&tv, 0, &ts)
+
+	if ts.matchFound == true {
+		return 0, ts.lastMatchPfxLen, ts.trieData
+	}
+	return TrieErrNoEnt, 0, nil
+}
+
+// TrieSetStrict - Set strict mode for a trie
+// In strict mode, AddTrie rejects non-canonical cidrs i.e. the ones having
+// host bits set beyond prefix length, with TrieErrHostBits. Otherwise those
+// bits are silently masked
+func (t *TrieRoot) TrieSetStrict(strict bool) {
+	t.strict = strict
+}
+
 // Trie2String - stringify the trie table
 func (t *TrieRoot) Trie2String(tf TrieIterIntf) {
 	var ts = trieState{0, 0, 0, false, trieVar{}, false, 4, 0}
@@ -0,0 +1,226 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright Copyright (c) 2022 NetLOX Inc
+
+package loxilib
+
+import (
+	"bytes"
+	"sort"
+)
+
+// TrieCopyFn - Function to copy user-defined data while cloning a trie
+type TrieCopyFn func(d TrieData) TrieData
+
+// TrieBulkEntry - A trie entry to be bulk loaded
+type TrieBulkEntry struct {
+	Cidr string
+	Data TrieData
+}
+
+// TrieBulkResult - Result of a bulk load
+// Failed maps index of each entry which could not be added to its error code
+type TrieBulkResult struct {
+	Added  int
+	Failed map[int]int
+}
+
+type trieBulkEnt struct {
+	tv     trieVar
+	pfxLen int
+	data   TrieData
+	idx    int
+}
+
+func (t *TrieRoot) cloneInt(cf TrieCopyFn) *TrieRoot {
+	n := new(TrieRoot)
+	*n = *t
+	n.exp = nil
+	n.rIdx = nil
+
+	if cf != nil {
+		nPfx := CountAllSetBitsInArr(t.prefixArr[:])
+		for i := 0; i < nPfx; i++ {
+			n.prefixData[i] = cf(t.prefixData[i])
+		}
+	}
+
+	nPtr := CountAllSetBitsInArr(t.ptrArr[:])
+	for i := 0; i < nPtr; i++ {
+		if t.ptrData[i] != nil {
+			n.ptrData[i] = t.ptrData[i].cloneInt(cf)
+		}
+	}
+	return n
+}
+
+// CloneTrie - Make a deep copy of the trie
+// cf, if not nil, is used to copy user-defined data of each entry,
+// otherwise data is copied as is. Expiry of entries is retained
+// returns the new trie
+func (t *TrieRoot) CloneTrie(cf TrieCopyFn) *TrieRoot {
+	n := t.cloneInt(cf)
+	if t.exp != nil {
+		e := n.expiry()
+		e.clock = t.exp.clock
+		e.notify = t.exp.notify
+		for key, ent := range t.exp.ents {
+			e.set(key, ent.deadline)
+		}
+	}
+	if t.rIdx != nil {
+		n.TrieEnableRevIndex(t.rIdx.keyFn)
+	}
+	return n
+}
+
+// ClearTrie - Remove all entries from the trie
+// Settings like strict mode, expiry clock, notifier and reverse index
+// key function are retained
+func (t *TrieRoot) ClearTrie() {
+	exp := t.exp
+	rIdx := t.rIdx
+	*t = TrieRoot{v6: t.v6, strict: t.strict, keyLen: t.keyLen}
+	if exp != nil {
+		e := t.expiry()
+		e.clock = exp.clock
+		e.notify = exp.notify
+	}
+	if rIdx != nil {
+		t.TrieEnableRevIndex(rIdx.keyFn)
+	}
+}
+
+func (t *TrieRoot) bulkAddInt(ents []trieBulkEnt, level int, res *TrieBulkResult) {
+	var newPfx = make(map[int]TrieData)
+	var newPtr = make(map[int]*TrieRoot)
+	var oldPfxArr = t.prefixArr
+	var oldPtrArr = t.ptrArr
+
+	for s := 0; s < len(ents); {
+		ent := &ents[s]
+		cval := ent.tv.prefix[level]
+		rPfxLen := ent.pfxLen - level*TrieJmpLength
+
+		if rPfxLen <= TrieJmpLength {
+			idx := (1 << rPfxLen) - 1 + int(cval>>(TrieJmpLength-rPfxLen))
+			if IsBitSetInArr(t.prefixArr[:], idx) == true {
+				res.Failed[ent.idx] = TrieErrExists
+			} else {
+				SetBitInArr(t.prefixArr[:], idx)
+				newPfx[idx] = ent.data
+				res.Added++
+			}
+			s++
+			continue
+		}
+
+		// Entries going down the same pointer are contiguous as these
+		// are sorted. Children are built completely before their parent
+		e := s + 1
+		for e < len(ents) && ents[e].tv.prefix[level] == cval &&
+			ents[e].pfxLen > (level+1)*TrieJmpLength {
+			e++
+		}
+		var nextRoot *TrieRoot
+		if IsBitSetInArr(oldPtrArr[:], int(cval)) == true {
+			nextRoot = t.ptrData[CountSetBitsInArr(oldPtrArr[:], int(cval)-1)]
+		} else if nextRoot = newPtr[int(cval)]; nextRoot == nil {
+			nextRoot = new(TrieRoot)
+			newPtr[int(cval)] = nextRoot
+		}
+		nextRoot.bulkAddInt(ents[s:e], level+1, res)
+		s = e
+	}
+
+	if len(newPfx) > 0 {
+		var pfxData [PrefixArrLenfth]TrieData
+		oi, ni := 0, 0
+		for p := 0; p < PrefixArrLenfth; p++ {
+			if data, ok := newPfx[p]; ok {
+				pfxData[ni] = data
+				ni++
+			} else if IsBitSetInArr(oldPfxArr[:], p) == true {
+				pfxData[ni] = t.prefixData[oi]
+				oi++
+				ni++
+			}
+		}
+		t.prefixData = pfxData
+	}
+
+	if len(newPtr) > 0 {
+		var ptrData [PtrArrLength]*TrieRoot
+		oi, ni := 0, 0
+		for p := 0; p < PtrArrLength; p++ {
+			if nextRoot, ok := newPtr[p]; ok {
+				SetBitInArr(t.ptrArr[:], p)
+				ptrData[ni] = nextRoot
+				ni++
+			} else if IsBitSetInArr(oldPtrArr[:], p) == true {
+				ptrData[ni] = t.ptrData[oi]
+				oi++
+				ni++
+			}
+		}
+		t.ptrData = ptrData
+	}
+}
+
+// BulkLoadTrie - Add a list of entries to the trie in one go
+// Nodes are built bottom-up and each node's arrays are rearranged only once,
+// which is much faster than adding the entries one by one with AddTrie.
+// entries are best sorted by prefix, otherwise they get sorted first.
+// Entries which fail are reported in the result and the rest get added
+// returns result with number of entries added and the failed ones
+func (t *TrieRoot) BulkLoadTrie(entries []TrieBulkEntry) TrieBulkResult {
+	var res = TrieBulkResult{Failed: make(map[int]int)}
+	var ents = make([]trieBulkEnt, 0, len(entries))
+
+	for i, e := range entries {
+		var be = trieBulkEnt{data: e.Data, idx: i}
+		var hostBits bool
+
+		be.pfxLen, hostBits = cidr2TrieVarExt(e.Cidr, &be.tv)
+		if be.pfxLen < 0 || t.keyLen > 0 {
+			res.Failed[i] = TrieErrPrefix
+			continue
+		}
+		if hostBits == true && t.strict == true {
+			res.Failed[i] = TrieErrHostBits
+			continue
+		}
+		ents = append(ents, be)
+	}
+
+	less := func(i, j int) bool {
+		if c := bytes.Compare(ents[i].tv.prefix[:], ents[j].tv.prefix[:]); c != 0 {
+			return c < 0
+		}
+		return ents[i].pfxLen < ents[j].pfxLen
+	}
+	if sort.SliceIsSorted(ents, less) == false {
+		sort.SliceStable(ents, less)
+	}
+
+	// Duplicates within the list itself
+	n := 0
+	for i := range ents {
+		if n > 0 && ents[i].tv == ents[n-1].tv && ents[i].pfxLen == ents[n-1].pfxLen {
+			res.Failed[ents[i].idx] = TrieErrExists
+			continue
+		}
+		ents[n] = ents[i]
+		n++
+	}
+
+	t.bulkAddInt(ents[:n], 0, &res)
+
+	if t.rIdx != nil {
+		for i := range ents[:n] {
+			if _, failed := res.Failed[ents[i].idx]; failed == false {
+				t.rIdx.add(trieKey{ents[i].tv, ents[i].pfxLen}, ents[i].data)
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,106 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright Copyright (c) 2022 NetLOX Inc
+
+package loxilib
+
+import (
+	"fmt"
+)
+
+// Kinds of issues reported by TrieValidateCidrs
+const (
+	TrieIssueInvalid = iota
+	TrieIssueHostBits
+	TrieIssueDuplicate
+	TrieIssueOverlap
+)
+
+// TrieCidrEntry - A cidr along with a user label to be validated
+type TrieCidrEntry struct {
+	Cidr  string
+	Label string
+}
+
+// TrieCidrIssue - A problem found in a cidr list
+// Entry is the offending entry. For duplicates, Other is the first entry
+// having the same prefix and for overlaps, Other is the entry covering it
+type TrieCidrIssue struct {
+	Kind  int
+	Entry TrieCidrEntry
+	Other TrieCidrEntry
+}
+
+func (i TrieCidrIssue) String() string {
+	switch i.Kind {
+	case TrieIssueInvalid:
+		return fmt.Sprintf("%s (%s) is not a valid cidr", i.Entry.Cidr, i.Entry.Label)
+	case TrieIssueHostBits:
+		return fmt.Sprintf("%s (%s) has host bits set", i.Entry.Cidr, i.Entry.Label)
+	case TrieIssueDuplicate:
+		return fmt.Sprintf("%s (%s) duplicates %s (%s)", i.Entry.Cidr, i.Entry.Label,
+			i.Other.Cidr, i.Other.Label)
+	case TrieIssueOverlap:
+		return fmt.Sprintf("%s (%s) is covered by %s (%s)", i.Entry.Cidr, i.Entry.Label,
+			i.Other.Cidr, i.Other.Label)
+	}
+	return "unknown issue"
+}
+
+// TrieValidateCidrs - Validate a list of labelled cidrs
+// Reports invalid cidrs, cidrs with host bits set, duplicate prefixes and
+// prefixes which are covered by other (shorter) prefixes in the list.
+// IPv4 and IPv6 cidrs may be mixed in the same list
+// returns list of issues found. Overlaps are listed after all other issues
+func TrieValidateCidrs(entries []TrieCidrEntry) []TrieCidrIssue {
+	var issues []TrieCidrIssue
+	var tvs = make([]trieVar, len(entries))
+	var pfxLens = make([]int, len(entries))
+	var dup = make([]bool, len(entries))
+
+	roots := [2]*TrieRoot{TrieInit(false), TrieInit(true)}
+	family := func(cidr string) int {
+		if cidrIsV6(cidr) == true {
+			return 1
+		}
+		return 0
+	}
+
+	for i, e := range entries {
+		var hostBits bool
+		pfxLens[i], hostBits = cidr2TrieVarExt(e.Cidr, &tvs[i])
+		if pfxLens[i] < 0 {
+			issues = append(issues, TrieCidrIssue{Kind: TrieIssueInvalid, Entry: e})
+			continue
+		}
+		if hostBits == true {
+			issues = append(issues, TrieCidrIssue{Kind: TrieIssueHostBits, Entry: e})
+		}
+
+		// Trie data holds index+1 of first entry for the prefix
+		root := roots[family(e.Cidr)]
+		if root.addTrieVar(&tvs[i], pfxLens[i], i+1) == TrieErrExists {
+			root.findCoveringInt(&tvs[i], 0, pfxLens[i], func(pfxLen int, data TrieData) {
+				if pfxLen == pfxLens[i] {
+					issues = append(issues, TrieCidrIssue{Kind: TrieIssueDuplicate,
+						Entry: e, Other: entries[data.(int)-1]})
+				}
+			})
+			dup[i] = true
+		}
+	}
+
+	for i, e := range entries {
+		if pfxLens[i] < 0 || dup[i] == true {
+			continue
+		}
+		root := roots[family(e.Cidr)]
+		root.findCoveringInt(&tvs[i], 0, pfxLens[i], func(pfxLen int, data TrieData) {
+			if pfxLen < pfxLens[i] {
+				issues = append(issues, TrieCidrIssue{Kind: TrieIssueOverlap,
+					Entry: e, Other: entries[data.(int)-1]})
+			}
+		})
+	}
+
+	return issues
+}
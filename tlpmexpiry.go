@@ -0,0 +1,175 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright Copyright (c) 2022 NetLOX Inc
+
+package loxilib
+
+import (
+	"container/heap"
+	"net"
+	"time"
+)
+
+// TrieExpiryFn - callback invoked for each trie entry removed on expiry
+type TrieExpiryFn func(ipn *net.IPNet, data TrieData)
+
+type trieExpEnt struct {
+	key      trieKey
+	deadline time.Time
+	hIdx     int
+}
+
+// trieExpHeap - min-heap of entries ordered by deadline
+type trieExpHeap []*trieExpEnt
+
+func (h trieExpHeap) Len() int           { return len(h) }
+func (h trieExpHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+func (h trieExpHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].hIdx = i
+	h[j].hIdx = j
+}
+
+func (h *trieExpHeap) Push(x interface{}) {
+	e := x.(*trieExpEnt)
+	e.hIdx = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *trieExpHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return e
+}
+
+type trieExpiry struct {
+	clock  func() time.Time
+	notify TrieExpiryFn
+	ents   map[trieKey]*trieExpEnt
+	eHeap  trieExpHeap
+}
+
+func (t *TrieRoot) expiry() *trieExpiry {
+	if t.exp == nil {
+		t.exp = new(trieExpiry)
+		t.exp.clock = time.Now
+		t.exp.ents = make(map[trieKey]*trieExpEnt)
+	}
+	return t.exp
+}
+
+func (e *trieExpiry) set(key trieKey, deadline time.Time) {
+	if ent, ok := e.ents[key]; ok {
+		ent.deadline = deadline
+		heap.Fix(&e.eHeap, ent.hIdx)
+		return
+	}
+	ent := &trieExpEnt{key: key, deadline: deadline}
+	e.ents[key] = ent
+	heap.Push(&e.eHeap, ent)
+}
+
+func (e *trieExpiry) remove(key trieKey) {
+	if ent, ok := e.ents[key]; ok {
+		heap.Remove(&e.eHeap, ent.hIdx)
+		delete(e.ents, key)
+	}
+}
+
+// TrieSetClock - Set the clock used for expiry of trie entries
+// Defaults to time.Now and is mostly useful for tests
+func (t *TrieRoot) TrieSetClock(clock func() time.Time) {
+	t.expiry().clock = clock
+}
+
+// TrieSetExpiryNotify - Set a callback to be invoked for expired entries
+func (t *TrieRoot) TrieSetExpiryNotify(fn TrieExpiryFn) {
+	t.expiry().notify = fn
+}
+
+// AddTrieDeadline - Add a trie entry which expires at deadline
+// cidr is the route in cidr format and data is any user-defined data
+// returns 0 on success or non-zero error code on error
+func (t *TrieRoot) AddTrieDeadline(cidr string, data TrieData, deadline time.Time) int {
+	var tv trieVar
+
+	pfxLen := cidr2TrieVar(cidr, &tv)
+	if pfxLen < 0 {
+		return TrieErrPrefix
+	}
+
+	if ret := t.AddTrie(cidr, data); ret != 0 {
+		return ret
+	}
+	t.expiry().set(trieKey{tv, pfxLen}, deadline)
+	return 0
+}
+
+// AddTrieTTL - Add a trie entry which expires after ttl
+// cidr is the route in cidr format and data is any user-defined data
+// returns 0 on success or non-zero error code on error
+func (t *TrieRoot) AddTrieTTL(cidr string, data TrieData, ttl time.Duration) int {
+	return t.AddTrieDeadline(cidr, data, t.expiry().clock().Add(ttl))
+}
+
+// RefreshTrie - Push the expiry of an existing trie entry to ttl from now
+// An entry added without expiry becomes an expiring one
+// returns 0 on success or non-zero error code on error
+func (t *TrieRoot) RefreshTrie(cidr string, ttl time.Duration) int {
+	var tv trieVar
+
+	pfxLen := cidr2TrieVar(cidr, &tv)
+	if pfxLen < 0 {
+		return TrieErrPrefix
+	}
+
+	if _, found := t.findExactInt(&tv, pfxLen); found == false {
+		return TrieErrNoEnt
+	}
+	e := t.expiry()
+	e.set(trieKey{tv, pfxLen}, e.clock().Add(ttl))
+	return 0
+}
+
+// TrieNextExpiry - Get the earliest deadline among expiring entries
+// returns the deadline and false if no entry is set to expire
+func (t *TrieRoot) TrieNextExpiry() (time.Time, bool) {
+	if t.exp == nil || len(t.exp.eHeap) == 0 {
+		return time.Time{}, false
+	}
+	return t.exp.eHeap[0].deadline, true
+}
+
+// SweepTrie - Remove expired trie entries
+// At most max entries are removed in one call (no limit if max <= 0) so
+// that callers can bound the time spent per sweep. The expiry callback, if
+// set, is invoked for each removed entry
+// returns number of entries removed
+func (t *TrieRoot) SweepTrie(max int) int {
+	if t.exp == nil {
+		return 0
+	}
+
+	e := t.exp
+	now := e.clock()
+	n := 0
+	for len(e.eHeap) > 0 && (max <= 0 || n < max) {
+		ent := e.eHeap[0]
+		if ent.deadline.After(now) {
+			break
+		}
+		key := ent.key
+		data, _ := t.findExactInt(&key.tv, key.pfxLen)
+		e.remove(key)
+		if t.delTrieVar(&key.tv, key.pfxLen) != 0 {
+			continue
+		}
+		n++
+		if e.notify != nil {
+			e.notify(trieVar2IPNet(&key.tv, key.pfxLen, t.v6), data)
+		}
+	}
+	return n
+}
@@ -0,0 +1,106 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright Copyright (c) 2022 NetLOX Inc
+
+package loxilib
+
+import (
+	"bytes"
+	"net"
+	"sort"
+)
+
+// TrieKeyFn - Function to derive a key from user-defined data of a trie
+// entry for the reverse index. Returned key must be comparable
+type TrieKeyFn func(d TrieData) interface{}
+
+type trieRevIndex struct {
+	keyFn TrieKeyFn
+	pfxs  map[interface{}]map[trieKey]struct{}
+}
+
+func (r *trieRevIndex) add(key trieKey, data TrieData) {
+	dKey := r.keyFn(data)
+	pfxs := r.pfxs[dKey]
+	if pfxs == nil {
+		pfxs = make(map[trieKey]struct{})
+		r.pfxs[dKey] = pfxs
+	}
+	pfxs[key] = struct{}{}
+}
+
+func (r *trieRevIndex) remove(key trieKey, data TrieData) {
+	dKey := r.keyFn(data)
+	if pfxs := r.pfxs[dKey]; pfxs != nil {
+		delete(pfxs, key)
+		if len(pfxs) == 0 {
+			delete(r.pfxs, dKey)
+		}
+	}
+}
+
+// TrieEnableRevIndex - Maintain a reverse index from data to prefixes
+// kf derives the index key from user-defined data of each entry. Existing
+// entries are indexed right away and the index is kept up to date as
+// entries are added or deleted. With nil kf, data itself is the key
+func (t *TrieRoot) TrieEnableRevIndex(kf TrieKeyFn) {
+	if kf == nil {
+		kf = func(d TrieData) interface{} { return d }
+	}
+	t.rIdx = &trieRevIndex{keyFn: kf, pfxs: make(map[interface{}]map[trieKey]struct{})}
+	t.walkEntriesInt(&trieVar{}, 0, func(tv *trieVar, pfxLen int, data TrieData) bool {
+		t.rIdx.add(trieKey{*tv, pfxLen}, data)
+		return true
+	})
+}
+
+// sortedKeys returns the prefixes whose data maps to key ordered by
+// address and then by prefix length
+func (r *trieRevIndex) sortedKeys(key interface{}) []trieKey {
+	pfxs := r.pfxs[key]
+	keys := make([]trieKey, 0, len(pfxs))
+	for pKey := range pfxs {
+		keys = append(keys, pKey)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if c := bytes.Compare(keys[i].tv.prefix[:], keys[j].tv.prefix[:]); c != 0 {
+			return c < 0
+		}
+		return keys[i].pfxLen < keys[j].pfxLen
+	})
+	return keys
+}
+
+// FindTrieByData - List all prefixes whose data maps to key
+// Needs reverse index to be enabled with TrieEnableRevIndex
+// returns list of prefixes in *net.IPNet form ordered by address and then
+// by prefix length
+func (t *TrieRoot) FindTrieByData(key interface{}) []*net.IPNet {
+	var res []*net.IPNet
+
+	if t.rIdx == nil {
+		return nil
+	}
+
+	for _, pKey := range t.rIdx.sortedKeys(key) {
+		res = append(res, trieVar2IPNet(&pKey.tv, pKey.pfxLen, t.v6))
+	}
+	return res
+}
+
+// DelTrieByData - Delete all prefixes whose data maps to key
+// Needs reverse index to be enabled with TrieEnableRevIndex
+// returns number of entries deleted or negative error code on error
+func (t *TrieRoot) DelTrieByData(key interface{}) int {
+	if t.rIdx == nil {
+		return TrieErrGeneric
+	}
+
+	keys := t.rIdx.sortedKeys(key)
+	n := 0
+	for i := range keys {
+		if t.delTrieVar(&keys[i].tv, keys[i].pfxLen) == 0 {
+			n++
+		}
+	}
+	return n
+}
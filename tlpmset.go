@@ -0,0 +1,151 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright Copyright (c) 2022 NetLOX Inc
+
+package loxilib
+
+// pfxSetNode - node of a binary (1-bit stride) tree describing the
+// address space covered by a set of prefixes. A full node covers its
+// entire block and has no children, a nil node covers nothing
+type pfxSetNode struct {
+	full  bool
+	child [2]*pfxSetNode
+}
+
+var pfxSetFull = &pfxSetNode{full: true}
+
+func pfxSetJoin(c0 *pfxSetNode, c1 *pfxSetNode) *pfxSetNode {
+	if c0 == nil && c1 == nil {
+		return nil
+	}
+	if c0 != nil && c0.full && c1 != nil && c1.full {
+		return pfxSetFull
+	}
+	return &pfxSetNode{child: [2]*pfxSetNode{c0, c1}}
+}
+
+func pfxSetInsert(n *pfxSetNode, tv *trieVar, depth int, pfxLen int) *pfxSetNode {
+	if n != nil && n.full {
+		return n
+	}
+	if depth == pfxLen {
+		return pfxSetFull
+	}
+	var c [2]*pfxSetNode
+	if n != nil {
+		c = n.child
+	}
+	b := tv.bit(depth)
+	c[b] = pfxSetInsert(c[b], tv, depth+1, pfxLen)
+	return pfxSetJoin(c[0], c[1])
+}
+
+func pfxSetUnion(a *pfxSetNode, b *pfxSetNode) *pfxSetNode {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	if a.full || b.full {
+		return pfxSetFull
+	}
+	return pfxSetJoin(pfxSetUnion(a.child[0], b.child[0]),
+		pfxSetUnion(a.child[1], b.child[1]))
+}
+
+func pfxSetIntersect(a *pfxSetNode, b *pfxSetNode) *pfxSetNode {
+	if a == nil || b == nil {
+		return nil
+	}
+	if a.full {
+		return b
+	}
+	if b.full {
+		return a
+	}
+	return pfxSetJoin(pfxSetIntersect(a.child[0], b.child[0]),
+		pfxSetIntersect(a.child[1], b.child[1]))
+}
+
+func pfxSetSubtract(a *pfxSetNode, b *pfxSetNode) *pfxSetNode {
+	if a == nil || b == nil {
+		return a
+	}
+	if b.full {
+		return nil
+	}
+	ac := a.child
+	if a.full {
+		// Split the covered block so that holes can be punched into it
+		ac = [2]*pfxSetNode{pfxSetFull, pfxSetFull}
+	}
+	return pfxSetJoin(pfxSetSubtract(ac[0], b.child[0]),
+		pfxSetSubtract(ac[1], b.child[1]))
+}
+
+func (t *TrieRoot) trie2PfxSet() *pfxSetNode {
+	var set *pfxSetNode
+	t.walkEntriesInt(&trieVar{}, 0, func(tv *trieVar, pfxLen int, data TrieData) bool {
+		set = pfxSetInsert(set, tv, 0, pfxLen)
+		return true
+	})
+	return set
+}
+
+func (t *TrieRoot) addPfxSet(n *pfxSetNode, tv *trieVar, depth int, data TrieData) int {
+	if n == nil {
+		return 0
+	}
+	if n.full {
+		return t.addTrieVar(tv, depth, data)
+	}
+	for b := 0; b < 2; b++ {
+		ctv := *tv
+		if b == 1 {
+			ctv.setBit(depth)
+		}
+		if ret := t.addPfxSet(n.child[b], &ctv, depth+1, data); ret != 0 {
+			return ret
+		}
+	}
+	return 0
+}
+
+func trieSetOp(t1 *TrieRoot, t2 *TrieRoot, data TrieData,
+	op func(a *pfxSetNode, b *pfxSetNode) *pfxSetNode) (int, *TrieRoot) {
+	if t1 == nil || t2 == nil || t1.v6 != t2.v6 || t1.keyLen != t2.keyLen {
+		return TrieErrGeneric, nil
+	}
+
+	set := op(t1.trie2PfxSet(), t2.trie2PfxSet())
+	res := TrieInit(t1.v6)
+	res.keyLen = t1.keyLen
+	if ret := res.addPfxSet(set, &trieVar{}, 0, data); ret != 0 {
+		return ret, nil
+	}
+	return 0, res
+}
+
+// TrieUnion - Compute union of address space covered by two tries
+// Both tries need to be of the same address family. Result is a new trie
+// holding the minimal set of prefixes covering the union, each with data
+// returns 0 and the new trie on success or non-zero error code on error
+func TrieUnion(t1 *TrieRoot, t2 *TrieRoot, data TrieData) (int, *TrieRoot) {
+	return trieSetOp(t1, t2, data, pfxSetUnion)
+}
+
+// TrieIntersect - Compute intersection of address space covered by two tries
+// Both tries need to be of the same address family. Result is a new trie
+// holding the minimal set of prefixes covering the intersection, each with data
+// returns 0 and the new trie on success or non-zero error code on error
+func TrieIntersect(t1 *TrieRoot, t2 *TrieRoot, data TrieData) (int, *TrieRoot) {
+	return trieSetOp(t1, t2, data, pfxSetIntersect)
+}
+
+// TrieSubtract - Compute address space covered by t1 but not by t2
+// Both tries need to be of the same address family. Result is a new trie
+// holding the minimal set of prefixes covering the difference, each with data
+// returns 0 and the new trie on success or non-zero error code on error
+func TrieSubtract(t1 *TrieRoot, t2 *TrieRoot, data TrieData) (int, *TrieRoot) {
+	return trieSetOp(t1, t2, data, pfxSetSubtract)
+}
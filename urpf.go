@@ -0,0 +1,76 @@
+// SPDX-License-Identifier: Apache 2.0
+// Copyright Copyright (c) 2022 NetLOX Inc
+
+package loxilib
+
+import (
+	"net"
+)
+
+// uRPF modes
+const (
+	URPFLoose = iota
+	URPFStrict
+)
+
+// URPFRoute - Interface to be implemented by route data (TrieData) for
+// reverse-path-forwarding checks
+type URPFRoute interface {
+	// URPFIntfs returns the outgoing interfaces of the route. ECMP routes
+	// return all of their interfaces, a null route returns none
+	URPFIntfs() []string
+}
+
+// URPFIntfList - A simple list of outgoing interfaces usable as route data
+type URPFIntfList []string
+
+// URPFIntfs - Return outgoing interfaces of the route
+func (l URPFIntfList) URPFIntfs() []string {
+	return l
+}
+
+// URPFOpts - Options for reverse-path-forwarding checks
+// Mode is URPFLoose or URPFStrict. Default route is not considered a valid
+// reverse path unless AllowDefault is set
+type URPFOpts struct {
+	Mode         int
+	AllowDefault bool
+}
+
+// URPFCheck - Do a unicast reverse-path-forwarding check for a packet
+// rt is the route trie whose data implements URPFRoute, srcIP is source
+// address of the packet in string format and inIntf is its ingress
+// interface. In loose mode, a usable route back to the source is enough.
+// In strict mode, the route also needs to point out of inIntf, any of
+// the ECMP interfaces is fine
+// returns true if packet passes the check
+func URPFCheck(rt *TrieRoot, srcIP string, inIntf string, opts URPFOpts) bool {
+	var ret int
+	var ipn *net.IPNet
+	var data TrieData
+
+	if ret, ipn, data = rt.FindTrie(srcIP); ret != 0 {
+		return false
+	}
+
+	if pfxLen, _ := ipn.Mask.Size(); pfxLen == 0 && opts.AllowDefault == false {
+		return false
+	}
+
+	route, ok := data.(URPFRoute)
+	if !ok {
+		return false
+	}
+	intfs := route.URPFIntfs()
+
+	if opts.Mode != URPFStrict {
+		return len(intfs) > 0
+	}
+
+	for _, intf := range intfs {
+		if intf == inIntf {
+			return true
+		}
+	}
+	return false
+}